@@ -1,24 +1,64 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 )
 
 // ExchangeRateResponse структура ответа от API
 type ExchangeRateResponse struct {
-	Base             string             `json:"base"`
-	Date             string             `json:"date"`
-	Rates            map[string]float64 `json:"rates"`
-	TimeLastUpdated  int64              `json:"time_last_updated"`
+	Base            string             `json:"base"`
+	Date            string             `json:"date"`
+	Rates           map[string]float64 `json:"rates"`
+	TimeLastUpdated int64              `json:"time_last_updated"`
+	Provider        string             `json:"provider,omitempty"`      // заполняется при загрузке
+	Cached          bool               `json:"-"`                       // курсы взяты из кэша
+	Bid             map[string]float64 `json:"bid,omitempty"`           // цены покупки, если провайдер их отдаёт
+	Ask             map[string]float64 `json:"ask,omitempty"`           // цены продажи, если провайдер их отдаёт
+	RequestURL      string             `json:"request_url,omitempty"`   // адрес запроса без секретов
+	ResponseHash    string             `json:"response_hash,omitempty"` // sha256 тела ответа провайдера
+}
+
+// AuditRecord строка журнала аудита (--audit-log), одна на операцию
+type AuditRecord struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Provider     string    `json:"provider"`
+	RequestURL   string    `json:"request_url"`
+	ResponseHash string    `json:"response_hash"`
+	Cached       bool      `json:"cached"`
+	FromCurrency string    `json:"from_currency"`
+	ToCurrency   string    `json:"to_currency"`
+	Amount       float64   `json:"amount"`
+	Result       float64   `json:"result"`
+	ExchangeRate float64   `json:"exchange_rate"`
 }
 
 // ConversionRecord запись об одной конвертации
@@ -42,13 +82,58 @@ type JSONOutput struct {
 	Result         float64   `json:"result"`
 	ExchangeRate   float64   `json:"exchange_rate"`
 	RateUpdateTime time.Time `json:"rate_update_time"`
+	Provider       string    `json:"provider"`
+	Cached         bool      `json:"cached"`
+	ReceiptID      string    `json:"receipt_id,omitempty"`
+}
+
+// Receipt квитанция о конвертации с уникальным идентификатором (--receipt)
+type Receipt struct {
+	ID        string
+	Timestamp time.Time
+	From      string
+	To        string
+	Amount    float64
+	Rate      float64
+	Result    float64
+	Provider  string
 }
 
 // Config структура конфигурационного файла
 type Config struct {
-	DefaultFrom  string `json:"default_from"`
-	DefaultTo    string `json:"default_to"`
-	OutputFormat string `json:"output_format"`
+	DefaultFrom         string                `json:"default_from"`
+	DefaultTo           string                `json:"default_to"`
+	OutputFormat        string                `json:"output_format"`
+	BaseAmount          float64               `json:"base_amount"`
+	BaseCurrency        string                `json:"base_currency"`
+	PromptFrom          string                `json:"prompt_from"`
+	PromptTo            string                `json:"prompt_to"`
+	PromptAmount        string                `json:"prompt_amount"`
+	Locale              string                `json:"locale"`
+	VerifyFactor        float64               `json:"verify_factor"`
+	StaleWarnAfter      string                `json:"stale_warn_after"`
+	StaleAfter          string                `json:"stale_after"`
+	MagnitudeThreshold  float64               `json:"magnitude_threshold"`
+	MaxIdleConns        int                   `json:"max_idle_conns"`
+	IdleConnTimeout     string                `json:"idle_conn_timeout"`
+	SymbolPrecedence    map[string]string     `json:"symbol_precedence"`
+	RetryIdempotentOnly *bool                 `json:"retry_idempotent_only"`
+	LargeBatchThreshold int                   `json:"large_batch_threshold"`
+	MinorUnits          map[string]int        `json:"minor_units"`
+	NetProfiles         map[string]NetProfile `json:"net_profiles"`
+}
+
+// NetProfile именованный сетевой профиль из конфига (--net-profile)
+type NetProfile struct {
+	Proxy   string `json:"proxy"`   // URL прокси: http, https или socks5
+	CACert  string `json:"ca_cert"` // путь к PEM-файлу дополнительного корневого сертификата
+	Timeout string `json:"timeout"` // общий таймаут запроса, как --timeout
+}
+
+// BaseAmount базовая сумма, от которой считаются проценты в режиме --percent
+type BaseAmount struct {
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
 }
 
 // TableRow строка таблицы результатов конвертации
@@ -58,20 +143,376 @@ type TableRow struct {
 	Rate     float64
 }
 
+// Options параметры запуска, заданные флагами командной строки
+type Options struct {
+	Format              string // формат вывода из флага (пусто — из конфига)
+	Offline             bool
+	List                bool
+	All                 bool
+	SinceLastRun        bool
+	Verbose             bool
+	Strict              bool // предупреждения считаются ошибками
+	PrecisionInverse    int  // знаков после запятой в строке обратного курса
+	MaxTargets          int  // максимум целевых валют в выводе (0 — без ограничения)
+	SetBaseAmount       bool // сохранить базовую сумму из аргументов <amount> <currency>
+	ClearBaseAmount     bool
+	UsePercent          bool          // сумма задана процентом (--percent)
+	Percent             float64       // процент от базовой или явно указанной суммы
+	Hold                bool          // симуляция --convert-and-hold
+	HoldValue           float64       // прогнозный курс или изменение курса в процентах
+	HoldPercent         bool          // HoldValue задан в процентах
+	Via                 string        // промежуточная валюта для цепочки from → via → to
+	RoundIntermediate   bool          // округлять промежуточную сумму до копеек
+	TopMovers           bool          // показать валюты с наибольшим изменением курса
+	Days                int           // окно в днях для --top-movers
+	Locale              string        // локаль форматирования чисел (флаг > CC_LOCALE > конфиг)
+	PrecisionRate       int           // знаков после запятой в строке курса
+	CompactRateOnly     bool          // вывести только курс пары (для приглашения shell)
+	Portfolio           string        // файл с позициями портфеля
+	HoldingsFormat      string        // формат файла портфеля: csv, tsv, json (пусто — по расширению)
+	Verify              bool          // проверять курсы на аномалии по снимкам
+	VerifyWarn          bool          // при аномалии только предупреждать
+	VerifyFactor        float64       // допустимое отклонение от снимка (во сколько раз)
+	PairNotation        bool          // добавить строку вида USDRUB=92.5000
+	CacheList           bool          // вывести записи кэша
+	CachePrune          bool          // удалить устаревшие записи кэша
+	OlderThan           time.Duration // возраст записи для --cache-prune
+	UseTargetResult     bool          // режим --target-result
+	TargetResult        float64       // желаемая сумма в целевой валюте
+	NoPrompt            bool          // не запрашивать недостающие параметры интерактивно
+	AuditLog            string        // путь к журналу аудита (--audit-log)
+	PreferFreshWithin   time.Duration // брать кэш моложе этого окна, иначе загружать с откатом на кэш
+	InvoiceLabel        string        // подпись строки счёта (--invoice-label)
+	Batch               string        // CSV-файл пакетной конвертации: amount,from,to
+	Dedupe              bool          // схлопывать одинаковые строки пакета
+	NoColor             bool          // отключить цветной вывод
+	StaleWarnAfter      time.Duration // пороги индикатора свежести (из конфига)
+	StaleAfter          time.Duration
+	CompareToMid        bool          // показать bid/ask, mid и спред
+	MagnitudeWarn       bool          // предупреждать о слишком больших результатах
+	MagnitudeThreshold  float64       // порог для --magnitude-warn
+	Paths               ResponsePaths // пути к base/date/rates в ответе провайдера
+	Progress            bool          // индикатор выполнения для --batch и --portfolio
+	OutputSort          string        // порядок строк: input, value, code (пусто — по умолчанию режима)
+	ImpliedRate         bool          // режим --implied-rate: курс по двум известным суммам
+	Receipt             bool          // квитанция с UUID вместо обычного результата
+	Whole               []string      // валюты, результат в которых показывается без копеек
+	SelfTest            bool          // проверка ядра конвертации на встроенных данных
+	Align               bool          // выравнивать числа в строках результатов
+	ResultWidth         int           // ширина столбца результата при --align (считается по всем строкам)
+	RateWidth           int           // ширина столбца курса при --align
+	Smooth              int           // окно сглаживания курса в днях по локальным снимкам (0 — спотовый курс)
+	SmoothMethod        string        // способ сглаживания: median или mean
+	AlertAbove          float64       // оповещать, когда курс поднимается выше значения
+	AlertBelow          float64       // оповещать, когда курс опускается ниже значения
+	AlertRepeat         bool          // оповещать при каждом запуске, а не только при пересечении порога
+	Timeouts            HTTPTimeouts  // общий таймаут запроса и отдельные таймауты подключения и ответа
+	ExplainRounding     bool          // пошагово показывать округление результата, курса и итогов
+	ScanText            string        // целевая валюта для --scan-text: цены в тексте из stdin
+	From                string        // исходная валюта по умолчанию для вызова <to> <amount> (--from)
+	Retries             int           // число повторов запроса к API при сбое сети или 5xx/429
+	RetryIdempotentOnly bool          // повторять только идемпотентные запросы (перебивает конфиг)
+	AsFraction          bool          // показывать курс ещё и простой дробью
+	MaxDenominator      int64         // наибольший знаменатель дроби для --as-fraction
+	Info                string        // код валюты для --info
+	Then                string        // дата YYYY-MM-DD для сравнения «тогда и сейчас» (--then)
+	MaxResponseSize     int64         // предел размера ответа API в байтах (--max-response-size)
+	Yes                 bool          // подтверждать большой пакет без вопроса
+	LargeBatchThreshold int           // с какого числа строк --batch/--portfolio просить подтверждение
+	Flatten             bool          // свести все закэшированные таблицы к одной базе
+	FlattenTo           string        // база для --flatten (--to)
+	Export              string        // файл CSV для --flatten
+	PercentPrecision    int           // знаков после запятой в процентах (-1 — не задано)
+	NoPreview           bool          // не показывать сводку перед запросом в интерактивном режиме
+	FailFast            bool          // остановить --batch на первой строке с ошибкой
+	TimeoutBudget       time.Duration // --timeout-budget: предел времени на весь прогон --batch
+	ColorByMovement     bool          // цвет строки курса по изменению относительно прошлого снимка
+	OnlyChanged         bool          // --only-changed: выводить только пары, чей курс изменился с прошлой проверки
+	ColorDelta          bool          // --color-delta: зелёное/красное изменение курса
+	Bell                bool          // --bell: звуковой сигнал терминала при изменении курса
+	NoBell              bool          // --no-bell: подавить сигнал, в том числе из --watch-notify
+	NetProfile          string        // --net-profile: имя сетевого профиля из net_profiles конфига
+	ChangedOnly         bool          // --changed-only: в --all/--list только валюты, изменившиеся с прошлого снимка
+	MinChange           float64       // --min-change: минимальное изменение в процентах для --changed-only
+	RatesStdin          bool          // --rates-stdin: курсы из JSON в stdin вместо запроса к API
+	TrimZeros           bool          // --trim-zeros: убирать нули в конце дробной части в тексте и таблицах
+	Stream              bool          // --stream: суммы построчно из stdin, результаты построчно в stdout
+	NoCache             bool          // --no-cache: не читать кэш, всегда загружать курсы
+	NoCacheWrite        bool          // --no-cache-write: не записывать загруженные курсы в кэш
+	CompareDates        [2]string     // --compare-dates: две даты для сравнения курса пары по снимкам
+	RatePrecisionSet    bool          // точность курса задана явно (--precision-rate/--display-rate-precision)
+	Args                []string      // позиционные аргументы
+}
+
+// Snapshot снимок таблицы курсов базовой валюты за один день
+type Snapshot struct {
+	Date      string             `json:"date"` // YYYY-MM-DD
+	FetchedAt time.Time          `json:"fetched_at"`
+	Rates     map[string]float64 `json:"rates"`
+}
+
+// Mover изменение курса валюты за период (для --top-movers)
+type Mover struct {
+	Currency string  `json:"currency"`
+	OldRate  float64 `json:"old_rate"`
+	NewRate  float64 `json:"new_rate"`
+	Change   float64 `json:"change_percent"`
+}
+
+// Holding одна позиция портфеля
+type Holding struct {
+	Currency string  `json:"currency"`
+	Amount   float64 `json:"amount"`
+}
+
+// HoldingValue позиция портфеля, пересчитанная в целевую валюту
+type HoldingValue struct {
+	Holding
+	Value float64 `json:"value"`
+	Rate  float64 `json:"rate"` // 1 Currency = Rate целевой валюты
+}
+
+// CurrencyInfo справочные данные валюты
+type CurrencyInfo struct {
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	MinorUnits int    `json:"minor_units"`       // число знаков после запятой (ISO 4217)
+	Numeric    string `json:"numeric,omitempty"` // цифровой код ISO 4217
+	Region     string `json:"region,omitempty"`
+}
+
+// MidQuote двусторонняя котировка и отклонение эффективного курса от середины
+type MidQuote struct {
+	Bid           float64
+	Ask           float64
+	Mid           float64
+	SpreadPercent float64 // (ask - bid) / mid
+	RateVsMid     float64 // отклонение эффективного курса от mid, %
+}
+
+// ResponsePaths пути к полям ответа для нестандартных провайдеров (--json-*-path)
+type ResponsePaths struct {
+	Base  string
+	Date  string
+	Rates string
+}
+
+// BatchRow строка пакетной конвертации
+type BatchRow struct {
+	Line   int
+	Amount float64
+	From   string
+	To     string
+	Count  int // число одинаковых строк, схлопнутых --dedupe (0 — без схлопывания)
+}
+
+// BatchResult результат конвертации одной строки пакета
+type BatchResult struct {
+	Line   int          `json:"line"`
+	Amount float64      `json:"amount"`
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Result float64      `json:"result"`
+	Rate   float64      `json:"rate"`
+	Error  string       `json:"error,omitempty"`
+	Count  int          `json:"count,omitempty"`
+	Target CurrencyInfo `json:"-"`
+}
+
 // CacheEntry кэш курсов для одной базовой валюты
 type CacheEntry struct {
 	FetchedAt time.Time          `json:"fetched_at"`
 	Data      ExchangeRateResponse `json:"data"`
 }
 
+// apiURL адрес API курсов; переменная, чтобы в тестах подставлять локальный сервер
+var apiURL = "https://api.exchangerate-api.com/v4/latest/"
+
 const (
-	apiURL      = "https://api.exchangerate-api.com/v4/latest/"
-	historyFile = "history.json"
-	configFile  = "config.json"
-	cacheFile   = "cache.json"
-	cacheTTL    = 60 * time.Minute
+	providerName = "exchangerate-api.com"
+	historyFile  = "history.json"
+	baseFile     = "base_amount.json"
+	configFile   = "config.json"
+	cacheFile    = "cache.json"
+	snapsFile    = "snapshots.json"
+	alertsFile   = "alerts.json"
+	cacheTTL     = 60 * time.Minute
+
+	// Встроенные подсказки интерактивного режима; {default} заменяется значением по умолчанию
+	defaultPromptFrom   = "Введите исходную валюту (по умолчанию {default}): "
+	defaultPromptTo     = "Введите целевую валюту (по умолчанию {default}): "
+	defaultPromptAmount = "Введите сумму для конвертации: "
+	// При повторном вводе после отказа от сводки {default} — прежняя сумма
+	defaultPromptAmountEdit = "Введите сумму для конвертации (по умолчанию {default}): "
+
+	defaultTopMovers        = 10
+	defaultVerifyFactor     = 10
+	defaultRatePrecision    = 4
+	defaultInversePrecision = 6
+	maxInversePrecision     = 12
+	defaultInvoiceLabel     = "Service"
+	defaultMaxDenominator   = 1000
+	defaultMagnitude        = 1e9
+	defaultMaxIdleConns     = 10
+	defaultIdleConnTimeout  = 90 * time.Second
+	defaultRequestTimeout   = 10 * time.Second
+	defaultMaxResponseSize  = 4 << 20
+	defaultLargeBatch       = 1000
+	defaultPercentPrecision = 2
+	// Пороги свежести отсчитываются от времени курсов у провайдера, а не от записи
+	// в кэш: провайдеры обновляют таблицу раз в сутки, поэтому выводить их из cacheTTL
+	// (срок повторного использования локальной копии) нельзя — свежий ответ
+	// с суточной таблицей сразу оказался бы «устаревшим»
+	defaultStaleWarnAfter = 24 * time.Hour
+	defaultStaleAfter     = 48 * time.Hour
+
+	// exitMissingInput код возврата, когда аргументов не хватает, а спрашивать нельзя
+	exitMissingInput = 2
 )
 
+// verbose включает диагностический вывод (флаг --verbose)
+var verbose bool
+
+// httpClient общий HTTP-клиент запуска: соединения с провайдером переиспользуются
+// между запросами (пакет, портфель, --via)
+var httpClient = newHTTPClient(defaultMaxIdleConns, defaultIdleConnTimeout, HTTPTimeouts{})
+
+// preferFreshWithin окно свежести кэша (--prefer-fresh-within); 0 — обычный TTL
+var preferFreshWithin time.Duration
+
+// retryPolicy политика повторов запросов к провайдеру (--retries, retry_idempotent_only)
+var retryPolicy = RetryPolicy{IdempotentOnly: true}
+
+// percentPrecision знаков после запятой во всех выводах процентов (--percent-precision)
+var percentPrecision = defaultPercentPrecision
+
+// minorUnitsOverrides число знаков после запятой по коду валюты из minor_units конфига
+var minorUnitsOverrides map[string]int
+
+// maxMinorUnits наибольшее число знаков, допустимое в minor_units
+const maxMinorUnits = 6
+
+// requestContext контекст запросов к провайдеру; с --timeout-budget он ограничен сроком
+// прогона --batch, и запрос в полёте отменяется по истечении бюджета
+var requestContext = context.Background()
+
+// storeCheck проверка загруженных курсов перед записью в кэш и снимки (--verify);
+// false — курсы не сохраняются; nil — без проверки
+var storeCheck func(base string, rates *ExchangeRateResponse) bool
+
+// noCache не читать кэш и всегда загружать курсы (--no-cache)
+var noCache bool
+
+// noCacheWrite не записывать загруженные курсы в кэш (--no-cache-write)
+var noCacheWrite bool
+
+// trimZeros убирать нули в конце дробной части в текстовом и табличном выводе (--trim-zeros)
+var trimZeros bool
+
+// stdinRates курсы, прочитанные из stdin (--rates-stdin); nil — курсы берутся у провайдера
+var stdinRates *ExchangeRateResponse
+
+// maxResponseSize предел размера тела ответа провайдера (--max-response-size)
+var maxResponseSize int64 = defaultMaxResponseSize
+
+// retryBackoff пауза перед первым повтором, далее удваивается; переменная для тестов
+var retryBackoff = 200 * time.Millisecond
+
+// responsePaths пути к полям ответа (--json-*-path); пустые — стандартная схема
+var responsePaths ResponsePaths
+
+// auditLog открытый журнал аудита (--audit-log); nil, если журнал не ведётся
+var auditLog *os.File
+
+// warnings предупреждения, накопленные за запуск
+var warnings []string
+
+// supportedLocales локали для форматирования чисел (config locale, CC_LOCALE, --locale)
+var supportedLocales = []string{"ru-RU", "en-US", "en-GB", "de-DE"}
+
+// currencyTable справочник валют; для кодов вне справочника используются 2 знака
+var currencyTable = []CurrencyInfo{
+	{"USD", "Доллар США", 2, "840", "США"},
+	{"EUR", "Евро", 2, "978", "Еврозона"},
+	{"RUB", "Российский рубль", 2, "643", "Россия"},
+	{"GBP", "Фунт стерлингов", 2, "826", "Великобритания"},
+	{"CNY", "Китайский юань", 2, "156", "Китай"},
+	{"JPY", "Японская иена", 0, "392", "Япония"},
+	{"CHF", "Швейцарский франк", 2, "756", "Швейцария, Лихтенштейн"},
+	{"KZT", "Казахстанский тенге", 2, "398", "Казахстан"},
+	{"BYN", "Белорусский рубль", 2, "933", "Беларусь"},
+	{"UAH", "Украинская гривна", 2, "980", "Украина"},
+	{"TRY", "Турецкая лира", 2, "949", "Турция"},
+	{"AED", "Дирхам ОАЭ", 2, "784", "ОАЭ"},
+	{"INR", "Индийская рупия", 2, "356", "Индия"},
+	{"CAD", "Канадский доллар", 2, "124", "Канада"},
+	{"AUD", "Австралийский доллар", 2, "036", "Австралия"},
+	{"SEK", "Шведская крона", 2, "752", "Швеция"},
+	{"NOK", "Норвежская крона", 2, "578", "Норвегия"},
+	{"PLN", "Польский злотый", 2, "985", "Польша"},
+	{"CZK", "Чешская крона", 2, "203", "Чехия"},
+	{"KRW", "Южнокорейская вона", 0, "410", "Южная Корея"},
+	{"VND", "Вьетнамский донг", 0, "704", "Вьетнам"},
+	{"ISK", "Исландская крона", 0, "352", "Исландия"},
+	{"KWD", "Кувейтский динар", 3, "414", "Кувейт"},
+	{"BHD", "Бахрейнский динар", 3, "048", "Бахрейн"},
+	{"OMR", "Оманский риал", 3, "512", "Оман"},
+	{"JOD", "Иорданский динар", 3, "400", "Иордания"},
+	{"TND", "Тунисский динар", 3, "788", "Тунис"},
+}
+
+// currencySymbols валюты, обозначаемые символом; ключи в верхнем регистре,
+// при нескольких кандидатах выбор задаёт symbol_precedence из конфига
+var currencySymbols = map[string][]string{
+	"$":   {"USD", "CAD", "AUD", "NZD", "SGD", "HKD", "MXN"},
+	"US$": {"USD"},
+	"C$":  {"CAD"},
+	"A$":  {"AUD"},
+	"R$":  {"BRL"},
+	"€":   {"EUR"},
+	"£":   {"GBP"},
+	"¥":   {"JPY", "CNY"},
+	"₽":   {"RUB"},
+	"₸":   {"KZT"},
+	"₴":   {"UAH"},
+	"₺":   {"TRY"},
+	"₹":   {"INR"},
+	"₩":   {"KRW"},
+	"ZŁ":  {"PLN"},
+	"KR":  {"SEK", "NOK", "DKK", "ISK"},
+}
+
+// priceRegexp находит цены в тексте: символ или код перед суммой ($4.50, USD 10)
+// или после неё (4,50 €, 10 EUR); символы перебираются от длинных к коротким
+var priceRegexp = func() *regexp.Regexp {
+	symbols := make([]string, 0, len(currencySymbols))
+	for s := range currencySymbols {
+		symbols = append(symbols, s)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if len(symbols[i]) != len(symbols[j]) {
+			return len(symbols[i]) > len(symbols[j])
+		}
+		return symbols[i] < symbols[j]
+	})
+	for i, s := range symbols {
+		symbols[i] = regexp.QuoteMeta(s)
+	}
+	sym := `(?i:` + strings.Join(symbols, "|") + `)`
+	// Сначала суммы с разделителями тысяч (1,299.00, 1 200, 1.234,56), затем простые
+	number := `\d{1,3}(?:[ ,.\x{00a0}]\d{3})+(?:[.,]\d+)?|\d+(?:[.,]\d+)?`
+	return regexp.MustCompile(`(` + sym + `|\b[A-Z]{3}) ?(` + number + `)|\b(` + number + `) ?(` + sym + `|[A-Z]{3}\b)`)
+}()
+
+// outputSorts порядок строк результата для --output-sort
+var outputSorts = []string{"input", "value", "code"}
+
+// smoothMethods допустимые способы сглаживания для --smooth-method
+var smoothMethods = []string{"median", "mean"}
+
+// outputFormats известные форматы вывода (флаги и output_format в конфиге)
+var outputFormats = []string{"text", "json", "csv", "table", "markdown", "invoice", "fixed"}
+
 // parseConfig парсит JSON конфига в структуру Config
 func parseConfig(data []byte, cfg *Config) error {
 	return json.Unmarshal(data, cfg)
@@ -98,477 +539,5937 @@ func filterHistory(history []ConversionRecord, filter string) []ConversionRecord
 	return result
 }
 
-// loadConfig загружает конфигурацию из config.json
-func loadConfig() Config {
-	cfg := Config{
-		DefaultFrom:  "USD",
-		DefaultTo:    "RUB",
-		OutputFormat: "text",
+// isKnownFormat проверяет, что формат вывода поддерживается
+func isKnownFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
 	}
+	return false
+}
 
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		return cfg
+// validateConfig проверяет значения конфигурации и возвращает первую ошибку
+func validateConfig(cfg Config) error {
+	if errs := configErrors(cfg); len(errs) > 0 {
+		return errs[0]
 	}
+	return nil
+}
 
-	parseConfig(data, &cfg)
-	cfg.DefaultFrom = strings.ToUpper(cfg.DefaultFrom)
-	cfg.DefaultTo = strings.ToUpper(cfg.DefaultTo)
-	cfg.OutputFormat = strings.ToLower(cfg.OutputFormat)
-	return cfg
+// configErrors проверяет значения конфигурации и возвращает все найденные ошибки
+// (для --check-config); ключи словарей обходятся по порядку, чтобы вывод был стабильным
+func configErrors(cfg Config) []error {
+	var errs []error
+	if cfg.OutputFormat != "" && !isKnownFormat(cfg.OutputFormat) {
+		errs = append(errs, fmt.Errorf("неизвестный формат вывода %q (допустимо: %s)",
+			cfg.OutputFormat, strings.Join(outputFormats, ", ")))
+	}
+	currencyKeys := []struct{ key, value string }{
+		{"default_from", cfg.DefaultFrom}, {"default_to", cfg.DefaultTo}, {"base_currency", cfg.BaseCurrency},
+	}
+	for _, k := range currencyKeys {
+		if k.value == "" {
+			continue
+		}
+		// default_to может быть списком валют через запятую
+		for _, code := range strings.Split(k.value, ",") {
+			if _, err := lookupCurrency(code); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", k.key, err))
+			}
+		}
+	}
+	for _, code := range sortedKeys(cfg.MinorUnits) {
+		units := cfg.MinorUnits[code]
+		if !isCurrencyCode(strings.ToUpper(code)) {
+			errs = append(errs, fmt.Errorf("minor_units: неверный код валюты %q", code))
+		} else if units < 0 || units > maxMinorUnits {
+			errs = append(errs, fmt.Errorf("minor_units: число знаков для %s должно быть от 0 до %d, получено %d", code, maxMinorUnits, units))
+		}
+	}
+	for _, name := range sortedKeys(cfg.NetProfiles) {
+		if err := checkNetProfile(cfg.NetProfiles[name]); err != nil {
+			errs = append(errs, fmt.Errorf("net_profiles.%s: %v", name, err))
+		}
+	}
+	if cfg.LargeBatchThreshold < 0 {
+		errs = append(errs, fmt.Errorf("large_batch_threshold не может быть отрицательным, получено %d", cfg.LargeBatchThreshold))
+	}
+	if cfg.MagnitudeThreshold < 0 {
+		errs = append(errs, fmt.Errorf("magnitude_threshold не может быть отрицательным, получено %g", cfg.MagnitudeThreshold))
+	}
+	if cfg.VerifyFactor != 0 && cfg.VerifyFactor <= 1 {
+		errs = append(errs, fmt.Errorf("verify_factor должно быть больше 1, получено %g", cfg.VerifyFactor))
+	}
+	if cfg.Locale != "" && !isSupportedLocale(cfg.Locale) {
+		errs = append(errs, fmt.Errorf("неподдерживаемая локаль %q (допустимо: %s)",
+			cfg.Locale, strings.Join(supportedLocales, ", ")))
+	}
+	if _, _, err := stalenessThresholds(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := transportSettings(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	for _, symbol := range sortedKeys(cfg.SymbolPrecedence) {
+		if code := cfg.SymbolPrecedence[symbol]; !isCurrencyCode(strings.ToUpper(code)) {
+			errs = append(errs, fmt.Errorf("symbol_precedence: неверный код валюты %q для символа %q", code, symbol))
+		}
+	}
+	return errs
 }
 
-func main() {
-	// Проверяем флаг --help
-	if len(os.Args) > 1 && (os.Args[1] == "--help" || os.Args[1] == "-h") {
-		printHelp()
-		return
+// sortedKeys возвращает ключи словаря по алфавиту
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	// Проверяем флаг --history
-	if len(os.Args) > 1 && os.Args[1] == "--history" {
-		filter := ""
-		if len(os.Args) > 2 {
-			filter = strings.ToUpper(os.Args[2])
+// configKeys возвращает json-имена всех полей Config
+func configKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" {
+			keys = append(keys, name)
 		}
-		showHistory(filter)
-		return
 	}
+	return keys
+}
 
-	// Загружаем конфигурацию
-	cfg := loadConfig()
-
-	// Проверяем флаги --json, --csv, --table, --offline
-	jsonOutput := false
-	csvOutput := false
-	tableOutput := false
-	offlineMode := false
-	var args []string
-	for _, arg := range os.Args[1:] {
-		switch arg {
-		case "--json":
-			jsonOutput = true
-		case "--csv":
-			csvOutput = true
-		case "--table":
-			tableOutput = true
-		case "--offline":
-			offlineMode = true
-		default:
-			args = append(args, arg)
+// checkConfigData разбирает и проверяет конфиг для --check-config: возвращает
+// заданные ключи с числом элементов для словарей и все найденные ошибки, включая
+// неизвестные ключи (при обычном запуске они молча игнорируются)
+func checkConfigData(data []byte) (summary []string, errs []error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, []error{fmt.Errorf("ошибка парсинга: %v", err)}
+	}
+	var cfg Config
+	if err := parseConfig(data, &cfg); err != nil {
+		return nil, []error{fmt.Errorf("ошибка парсинга: %v", err)}
+	}
+	known := configKeys()
+	for _, key := range sortedKeys(raw) {
+		if !containsString(known, key) {
+			errs = append(errs, fmt.Errorf("неизвестный ключ %q", key))
+			continue
+		}
+		var entries map[string]json.RawMessage
+		if json.Unmarshal(raw[key], &entries) == nil {
+			summary = append(summary, fmt.Sprintf("%s (%d)", key, len(entries)))
+		} else {
+			summary = append(summary, key)
 		}
 	}
+	normalizeConfig(&cfg)
+	return summary, append(errs, configErrors(cfg)...)
+}
 
-	// Применяем формат вывода из конфига, если нет флагов
-	if !jsonOutput && !csvOutput && !tableOutput {
-		switch cfg.OutputFormat {
-		case "json":
-			jsonOutput = true
-		case "csv":
-			csvOutput = true
-		case "table":
-			tableOutput = true
+// runCheckConfig проверяет файл конфигурации без конвертации и печатает итог;
+// возвращает код завершения
+func runCheckConfig(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		color.Red("❌ Не удалось прочитать %s: %v", path, err)
+		return 1
+	}
+	summary, errs := checkConfigData(data)
+	if len(errs) > 0 {
+		color.Red("❌ %s: найдено ошибок: %d", path, len(errs))
+		for _, err := range errs {
+			color.Red("  • %v", err)
 		}
+		return 1
+	}
+	if len(summary) == 0 {
+		color.Green("✅ %s: конфиг пуст, используются значения по умолчанию", path)
+		return 0
 	}
+	color.Green("✅ %s: ошибок нет, проверено ключей: %d", path, len(summary))
+	color.HiBlack("  %s", strings.Join(summary, ", "))
+	return 0
+}
 
-	if !jsonOutput && !csvOutput {
-		printHeader()
+// transportSettings возвращает параметры keep-alive из конфига или значения по умолчанию
+func transportSettings(cfg Config) (maxIdle int, idleTimeout time.Duration, err error) {
+	maxIdle, idleTimeout = defaultMaxIdleConns, defaultIdleConnTimeout
+	if cfg.MaxIdleConns < 0 {
+		return 0, 0, fmt.Errorf("max_idle_conns не может быть отрицательным, получено %d", cfg.MaxIdleConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		maxIdle = cfg.MaxIdleConns
+	}
+	if cfg.IdleConnTimeout != "" {
+		if idleTimeout, err = parseDuration(cfg.IdleConnTimeout); err != nil || idleTimeout <= 0 {
+			return 0, 0, fmt.Errorf("неверное значение idle_conn_timeout: %s", cfg.IdleConnTimeout)
+		}
 	}
+	return maxIdle, idleTimeout, nil
+}
 
-	// Получаем параметры из командной строки или интерактивно
-	var fromCurrency, toCurrencyRaw string
-	var amount float64
+// checkNetProfile проверяет URL прокси и таймаут сетевого профиля
+func checkNetProfile(p NetProfile) error {
+	if p.Proxy != "" {
+		u, err := url.Parse(p.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("неверный proxy %q", p.Proxy)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return fmt.Errorf("неподдерживаемая схема прокси %q (допустимо: http, https, socks5)", u.Scheme)
+		}
+	}
+	if p.Timeout != "" {
+		if d, err := parseDuration(p.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("неверное значение timeout: %s", p.Timeout)
+		}
+	}
+	return nil
+}
 
-	if len(args) == 3 {
-		// Режим с аргументами командной строки
-		fromCurrency = strings.ToUpper(args[0])
-		toCurrencyRaw = strings.ToUpper(args[1])
-		var err error
-		amount, err = strconv.ParseFloat(args[2], 64)
+// lookupNetProfile находит сетевой профиль по имени; неизвестное имя — ошибка со списком доступных
+func lookupNetProfile(cfg Config, name string) (NetProfile, error) {
+	if p, ok := cfg.NetProfiles[name]; ok {
+		return p, nil
+	}
+	names := make([]string, 0, len(cfg.NetProfiles))
+	for n := range cfg.NetProfiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return NetProfile{}, fmt.Errorf("сетевой профиль %q не найден: в конфиге нет net_profiles", name)
+	}
+	return NetProfile{}, fmt.Errorf("сетевой профиль %q не найден (доступны: %s)", name, strings.Join(names, ", "))
+}
+
+// applyNetProfile настраивает прокси и корневой сертификат профиля на транспорте клиента
+func applyNetProfile(client *http.Client, p NetProfile) error {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("транспорт клиента не поддерживает сетевые профили")
+	}
+	if p.Proxy != "" {
+		proxyURL, err := url.Parse(p.Proxy)
 		if err != nil {
-			if jsonOutput || csvOutput {
-				outputError("неверная сумма", jsonOutput)
-			} else {
-				color.Red("❌ Ошибка: неверная сумма")
-			}
-			os.Exit(1)
+			return fmt.Errorf("неверный proxy %q: %v", p.Proxy, err)
 		}
-	} else if len(args) == 0 {
-		// Интерактивный режим с подсказками из конфига
-		fromCurrency = getInput(fmt.Sprintf("Введите исходную валюту (по умолчанию %s): ", cfg.DefaultFrom))
-		if fromCurrency == "" {
-			fromCurrency = cfg.DefaultFrom
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if p.CACert != "" {
+		pem, err := os.ReadFile(p.CACert)
+		if err != nil {
+			return fmt.Errorf("не удалось прочитать ca_cert: %v", err)
 		}
-		toCurrencyRaw = getInput(fmt.Sprintf("Введите целевую валюту (по умолчанию %s): ", cfg.DefaultTo))
-		if toCurrencyRaw == "" {
-			toCurrencyRaw = cfg.DefaultTo
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
 		}
-		amount = getAmount("Введите сумму для конвертации: ")
-	} else {
-		if jsonOutput || csvOutput {
-			outputError("неверное количество аргументов", jsonOutput)
-		} else {
-			color.Red("❌ Использование: %s [--json|--csv] <from> <to1[,to2,...]> <amount>", os.Args[0])
-			color.Red("   или: %s --history", os.Args[0])
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("в %s нет PEM-сертификатов", p.CACert)
 		}
-		os.Exit(1)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
 	}
+	return nil
+}
 
-	// Разбиваем целевые валюты (поддержка USD RUB,EUR,CNY 100)
-	toCurrencies := strings.Split(toCurrencyRaw, ",")
+// HTTPTimeouts таймауты запросов к провайдеру; нулевое значение — по умолчанию
+type HTTPTimeouts struct {
+	Total   time.Duration // общий предел на весь запрос (--timeout)
+	Connect time.Duration // установка соединения (--connect-timeout)
+	Read    time.Duration // ожидание заголовков ответа (--read-timeout)
+}
 
-	// Получаем курсы валют
-	if !jsonOutput && !csvOutput && !offlineMode {
-		color.Cyan("🔄 Загрузка актуальных курсов валют...")
+// checkTimeouts проверяет, что таймауты подключения и ответа не больше общего
+func checkTimeouts(t HTTPTimeouts) error {
+	total := t.Total
+	if total == 0 {
+		total = defaultRequestTimeout
 	}
-	rates, err := getExchangeRates(fromCurrency, jsonOutput || csvOutput, offlineMode)
-	if err != nil {
-		if jsonOutput || csvOutput {
-			outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
-		} else {
-			color.Red("❌ Ошибка при получении курсов: %v", err)
+	if t.Connect > total {
+		return fmt.Errorf("--connect-timeout (%s) не может быть больше общего --timeout (%s)", t.Connect, total)
+	}
+	if t.Read > total {
+		return fmt.Errorf("--read-timeout (%s) не может быть больше общего --timeout (%s)", t.Read, total)
+	}
+	return nil
+}
+
+// newHTTPClient создаёт клиент с собственным транспортом, настройками keep-alive
+// и таймаутами: подключение и ответ ограничиваются транспортом, весь запрос — клиентом
+func newHTTPClient(maxIdle int, idleTimeout time.Duration, timeouts HTTPTimeouts) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdle
+	transport.IdleConnTimeout = idleTimeout
+	if timeouts.Connect > 0 {
+		dialer := &net.Dialer{Timeout: timeouts.Connect, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = timeouts.Connect
+	}
+	if timeouts.Read > 0 {
+		transport.ResponseHeaderTimeout = timeouts.Read
+	}
+	total := timeouts.Total
+	if total == 0 {
+		total = defaultRequestTimeout
+	}
+	return &http.Client{Timeout: total, Transport: transport}
+}
+
+// timeoutKind определяет, на каком этапе истёк таймаут запроса: подключение,
+// ожидание ответа или общий предел; пустая строка — ошибка не по таймауту
+func timeoutKind(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return "таймаут подключения"
+	}
+	if strings.Contains(err.Error(), "awaiting response headers") {
+		return "таймаут ответа"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "общий таймаут запроса"
+	}
+	return ""
+}
+
+// stalenessThresholds возвращает пороги свежести курсов из конфига или значения по умолчанию
+func stalenessThresholds(cfg Config) (warn, stale time.Duration, err error) {
+	warn, stale = defaultStaleWarnAfter, defaultStaleAfter
+	if cfg.StaleWarnAfter != "" {
+		if warn, err = parseDuration(cfg.StaleWarnAfter); err != nil || warn <= 0 {
+			return 0, 0, fmt.Errorf("неверное значение stale_warn_after: %s", cfg.StaleWarnAfter)
 		}
-		os.Exit(1)
 	}
+	if cfg.StaleAfter != "" {
+		if stale, err = parseDuration(cfg.StaleAfter); err != nil || stale <= 0 {
+			return 0, 0, fmt.Errorf("неверное значение stale_after: %s", cfg.StaleAfter)
+		}
+	}
+	if warn > stale {
+		return 0, 0, fmt.Errorf("stale_warn_after (%s) не может быть больше stale_after (%s)", warn, stale)
+	}
+	return warn, stale, nil
+}
 
-	updateTime := time.Unix(rates.TimeLastUpdated, 0)
+// stalenessColor выбирает цвет строки обновления: зелёный — свежие курсы,
+// жёлтый — старше warn, красный — старше stale
+func stalenessColor(age, warn, stale time.Duration) color.Attribute {
+	switch {
+	case age >= stale:
+		return color.FgRed
+	case age >= warn:
+		return color.FgYellow
+	}
+	return color.FgGreen
+}
 
-	// Для табличного режима собираем все результаты, затем выводим таблицу
-	if tableOutput {
-		var rows []TableRow
-		for _, toCurrency := range toCurrencies {
-			toCurrency = strings.TrimSpace(toCurrency)
-			if toCurrency == "" {
-				continue
-			}
-			result, err := convertCurrency(amount, fromCurrency, toCurrency, rates)
-			if err != nil {
-				color.Red("❌ Ошибка конвертации для %s: %v", toCurrency, err)
-				continue
+// applyEnv применяет переменные окружения CC_LOCALE, CC_DEFAULT_FROM, CC_DEFAULT_TO
+func applyEnv(cfg *Config) {
+	if v := os.Getenv("CC_LOCALE"); v != "" {
+		cfg.Locale = v
+	}
+	if v := os.Getenv("CC_DEFAULT_FROM"); v != "" {
+		cfg.DefaultFrom = v
+	}
+	if v := os.Getenv("CC_DEFAULT_TO"); v != "" {
+		cfg.DefaultTo = v
+	}
+}
+
+// normalizeLocale приводит локаль к виду ru-RU: ru_RU.UTF-8 → ru-RU, ru → ru-RU
+func normalizeLocale(locale string) string {
+	locale = strings.TrimSpace(locale)
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "" {
+		return ""
+	}
+	parts := strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)
+	lang := strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		for _, l := range supportedLocales {
+			if strings.HasPrefix(l, lang+"-") {
+				return l
 			}
-			rate := rates.Rates[toCurrency]
-			saveToHistory(fromCurrency, toCurrency, amount, result, rate, updateTime)
-			rows = append(rows, TableRow{toCurrency, result, rate})
 		}
-		printTable(amount, fromCurrency, rows, rates)
-		return
+		return lang
 	}
+	return lang + "-" + strings.ToUpper(parts[1])
+}
 
-	// Выполняем конвертацию для каждой валюты
-	for _, toCurrency := range toCurrencies {
-		toCurrency = strings.TrimSpace(toCurrency)
-		if toCurrency == "" {
-			continue
-		}
+// regionCurrencies валюта по региону локали для выбора исходной валюты по умолчанию
+var regionCurrencies = map[string]string{
+	"RU": "RUB", "US": "USD", "GB": "GBP", "JP": "JPY", "CN": "CNY", "KZ": "KZT",
+	"UA": "UAH", "BY": "BYN", "TR": "TRY", "IN": "INR", "KR": "KRW", "PL": "PLN",
+	"SE": "SEK", "NO": "NOK", "DK": "DKK", "CH": "CHF", "CA": "CAD", "AU": "AUD",
+	"BR": "BRL", "DE": "EUR", "FR": "EUR", "IT": "EUR", "ES": "EUR", "NL": "EUR",
+	"AT": "EUR", "BE": "EUR", "FI": "EUR", "IE": "EUR", "PT": "EUR", "GR": "EUR",
+}
 
-		result, err := convertCurrency(amount, fromCurrency, toCurrency, rates)
-		if err != nil {
-			if jsonOutput || csvOutput {
-				outputError(fmt.Sprintf("ошибка конвертации: %v", err), jsonOutput)
-			} else {
-				color.Red("❌ Ошибка конвертации для %s: %v", toCurrency, err)
-			}
-			continue
+// systemLocale возвращает локаль окружения: LC_ALL, LC_MONETARY или LANG
+func systemLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MONETARY", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			return v
 		}
+	}
+	return ""
+}
 
-		rate := rates.Rates[toCurrency]
-		saveToHistory(fromCurrency, toCurrency, amount, result, rate, updateTime)
+// localeCurrency угадывает валюту по локали (ru-RU → RUB, en_US.UTF-8 → USD);
+// пустая строка, если регион не указан или неизвестен
+func localeCurrency(locale string) string {
+	locale = normalizeLocale(locale)
+	if _, region, ok := strings.Cut(locale, "-"); ok {
+		return regionCurrencies[region]
+	}
+	return ""
+}
 
-		if jsonOutput {
-			outputJSON(fromCurrency, toCurrency, amount, result, rate, updateTime)
-		} else if csvOutput {
-			outputCSV(fromCurrency, toCurrency, amount, result, rate, updateTime)
-		} else {
-			printResult(amount, fromCurrency, result, toCurrency, rates)
+// defaultSourceCurrency выбирает исходную валюту по умолчанию и описывает,
+// откуда она взята: флаг, конфиг, локаль (настройки программы, затем окружения) или USD;
+// валюта локали пропускается, если совпадает с целевой по умолчанию target (иначе RUB → RUB)
+func defaultSourceCurrency(flag, configured, locale, sysLocale, target string) (string, string) {
+	if flag != "" {
+		return flag, "флаг --from"
+	}
+	if configured != "" {
+		return configured, "default_from"
+	}
+	for _, l := range []string{locale, sysLocale} {
+		if code := localeCurrency(l); code != "" && !containsString(strings.Split(target, ","), code) {
+			return code, "по локали " + normalizeLocale(l)
 		}
 	}
+	return "USD", "по умолчанию"
 }
 
-// printHelp выводит справку по использованию программы
-func printHelp() {
-	color.Set(color.FgGreen, color.Bold)
-	fmt.Println("╔════════════════════════════════════════╗")
-	fmt.Println("║     КОНВЕРТЕР ВАЛЮТ (Go Version)       ║")
-	fmt.Println("╚════════════════════════════════════════╝")
-	color.Unset()
-	fmt.Println()
+// isSupportedLocale проверяет, что локаль есть в списке поддерживаемых
+func isSupportedLocale(locale string) bool {
+	for _, l := range supportedLocales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// localeSeparators возвращает разделители тысяч и дробной части для локали;
+// пустая локаль — без разделителя тысяч и с точкой
+func localeSeparators(locale string) (thousands, decimal string) {
+	switch locale {
+	case "ru-RU":
+		return "\u00a0", ","
+	case "de-DE":
+		return ".", ","
+	case "en-US", "en-GB":
+		return ",", "."
+	}
+	return "", "."
+}
+
+// formatNumber форматирует число с заданной точностью по правилам локали;
+// с --trim-zeros нули в конце дробной части убираются
+func formatNumber(value float64, decimals int, locale string) string {
+	text := strconv.FormatFloat(value, 'f', decimals, 64)
+	thousands, decimal := localeSeparators(locale)
+	if thousands == "" && decimal == "." {
+		if trimZeros {
+			return trimTrailingZeros(text, decimal)
+		}
+		return text
+	}
+
+	sign := ""
+	if strings.HasPrefix(text, "-") {
+		sign, text = "-", text[1:]
+	}
+	intPart, fracPart, hasFrac := strings.Cut(text, ".")
+
+	var b strings.Builder
+	for i, r := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(thousands)
+		}
+		b.WriteRune(r)
+	}
+	if hasFrac {
+		b.WriteString(decimal + fracPart)
+	}
+	if trimZeros {
+		return sign + trimTrailingZeros(b.String(), decimal)
+	}
+	return sign + b.String()
+}
+
+// trimTrailingZeros убирает нули в конце дробной части и оставшийся без цифр
+// десятичный разделитель: 9250.5000 → 9250.5, 9250.0000 → 9250
+func trimTrailingZeros(text, decimal string) string {
+	if !strings.Contains(text, decimal) {
+		return text
+	}
+	return strings.TrimSuffix(strings.TrimRight(text, "0"), decimal)
+}
+
+// tableNumber форматирует число для ячейки таблицы с учётом --trim-zeros
+func tableNumber(value float64, decimals int) string {
+	text := strconv.FormatFloat(value, 'f', decimals, 64)
+	if trimZeros {
+		return trimTrailingZeros(text, ".")
+	}
+	return text
+}
+
+// isMachineReadable сообщает, что формат предназначен для вставки или разбора
+// программами — в нём не выводятся заголовок, статусы загрузки и итоговые строки
+func isMachineReadable(format string) bool {
+	return format == "json" || format == "csv" || format == "markdown" || format == "invoice" || format == "fixed"
+}
+
+// resolveOutputFormat выбирает формат вывода: флаг командной строки перебивает конфиг
+func resolveOutputFormat(flagFormat, configFormat string) string {
+	if flagFormat != "" {
+		return flagFormat
+	}
+	if configFormat != "" {
+		return configFormat
+	}
+	return "text"
+}
+
+// loadConfig загружает конфигурацию из config.json
+func loadConfig() (Config, error) {
+	cfg := Config{
+		DefaultTo:    "RUB",
+		OutputFormat: "text",
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err == nil {
+		if err := parseConfig(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("ошибка парсинга %s: %w", configFile, err)
+		}
+	}
+
+	// Переменные окружения перебивают значения из файла (удобно для Docker)
+	applyEnv(&cfg)
+	normalizeConfig(&cfg)
+	if err := validateConfig(cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// normalizeConfig приводит коды валют, формат и локаль конфига к каноническому виду
+func normalizeConfig(cfg *Config) {
+	cfg.DefaultFrom = strings.ToUpper(cfg.DefaultFrom)
+	cfg.DefaultTo = strings.ToUpper(cfg.DefaultTo)
+	cfg.OutputFormat = strings.ToLower(cfg.OutputFormat)
+	cfg.BaseCurrency = strings.ToUpper(cfg.BaseCurrency)
+	cfg.Locale = normalizeLocale(cfg.Locale)
+}
+
+// parseFlags разбирает флаги командной строки, остальные аргументы
+// возвращаются в Options.Args
+func parseFlags(argv []string) (Options, error) {
+	opts := Options{
+		PrecisionInverse: defaultInversePrecision,
+		PrecisionRate:    defaultRatePrecision,
+		MaxDenominator:   defaultMaxDenominator,
+		PercentPrecision: -1,
+		Days:             7,
+		InvoiceLabel:     defaultInvoiceLabel,
+	}
+	for i := 0; i < len(argv); i++ {
+		arg := argv[i]
+		switch arg {
+		case "--json":
+			opts.Format = "json"
+		case "--csv":
+			opts.Format = "csv"
+		case "--table":
+			opts.Format = "table"
+		case "--invoice":
+			opts.Format = "invoice"
+		case "--invoice-label":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.InvoiceLabel = value
+		case "--format":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			format := strings.ToLower(value)
+			if !isKnownFormat(format) {
+				return opts, fmt.Errorf("неизвестный формат вывода %q (допустимо: %s)",
+					value, strings.Join(outputFormats, ", "))
+			}
+			opts.Format = format
+		case "--no-cache":
+			opts.NoCache = true
+		case "--no-cache-write":
+			opts.NoCacheWrite = true
+		case "--offline":
+			opts.Offline = true
+		case "--list":
+			opts.List = true
+		case "--all":
+			opts.All = true
+		case "--since-last-run":
+			opts.SinceLastRun = true
+		case "--only-changed":
+			opts.SinceLastRun = true
+			opts.OnlyChanged = true
+		case "--color-delta":
+			opts.SinceLastRun = true
+			opts.ColorDelta = true
+		case "--bell":
+			opts.SinceLastRun = true
+			opts.Bell = true
+		case "--no-bell":
+			opts.NoBell = true
+		case "--watch-notify":
+			opts.SinceLastRun = true
+			opts.OnlyChanged = true
+			opts.ColorDelta = true
+			opts.Bell = true
+		case "--strict":
+			opts.Strict = true
+		case "--verbose", "-v":
+			opts.Verbose = true
+		case "--precision-inverse":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.PrecisionInverse = n
+		case "--set-base-amount":
+			opts.SetBaseAmount = true
+		case "--clear-base-amount":
+			opts.ClearBaseAmount = true
+		case "--percent":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			p, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || p < 0 {
+				return opts, fmt.Errorf("неверное значение --percent: %s", value)
+			}
+			opts.UsePercent = true
+			opts.Percent = p
+		case "--convert-and-hold":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.HoldPercent = strings.HasSuffix(value, "%")
+			v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || (!opts.HoldPercent && v <= 0) {
+				return opts, fmt.Errorf("неверное значение --convert-and-hold: %s", value)
+			}
+			opts.Hold = true
+			opts.HoldValue = v
+		case "--via":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Via = strings.ToUpper(value)
+		case "--round-intermediate":
+			opts.RoundIntermediate = true
+		case "--top-movers":
+			opts.TopMovers = true
+		case "--days":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			if n == 0 {
+				return opts, fmt.Errorf("--days должно быть больше 0")
+			}
+			opts.Days = n
+		case "--locale":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Locale = normalizeLocale(value)
+			if !isSupportedLocale(opts.Locale) {
+				return opts, fmt.Errorf("неподдерживаемая локаль %q (допустимо: %s)",
+					value, strings.Join(supportedLocales, ", "))
+			}
+		case "--precision-rate", "--display-rate-precision":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.PrecisionRate = n
+			opts.RatePrecisionSet = true
+		case "--compact-rate-only":
+			opts.CompactRateOnly = true
+		case "--portfolio":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Portfolio = value
+		case "--batch":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Batch = value
+		case "--from":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.From = strings.ToUpper(value)
+		case "--then":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			if _, err := time.Parse("2006-01-02", value); err != nil {
+				return opts, fmt.Errorf("неверная дата --then: %s (ожидается YYYY-MM-DD)", value)
+			}
+			opts.Then = value
+		case "--compare-dates":
+			for k := range opts.CompareDates {
+				value, err := nextValue(argv, &i)
+				if err != nil {
+					return opts, fmt.Errorf("--compare-dates ожидает две даты: %w", err)
+				}
+				if _, err := time.Parse("2006-01-02", value); err != nil {
+					return opts, fmt.Errorf("неверная дата --compare-dates: %s (ожидается YYYY-MM-DD)", value)
+				}
+				opts.CompareDates[k] = value
+			}
+		case "--flatten":
+			opts.Flatten = true
+		case "--to":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.FlattenTo = strings.ToUpper(value)
+		case "--export":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Export = value
+		case "--info":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Info = value
+		case "--color-rate-by-movement":
+			opts.ColorByMovement = true
+		case "--no-preview":
+			opts.NoPreview = true
+		case "--scan-text":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.ScanText = strings.ToUpper(value)
+		case "--output-sort":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.OutputSort = strings.ToLower(value)
+			if !containsString(outputSorts, opts.OutputSort) {
+				return opts, fmt.Errorf("неизвестный порядок --output-sort %q (допустимо: %s)",
+					value, strings.Join(outputSorts, ", "))
+			}
+		case "--whole":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			for _, code := range strings.Split(value, ",") {
+				code = strings.ToUpper(strings.TrimSpace(code))
+				if !isCurrencyCode(code) {
+					return opts, fmt.Errorf("неверный код валюты в --whole: %q", code)
+				}
+				opts.Whole = append(opts.Whole, code)
+			}
+		case "--align":
+			opts.Align = true
+		case "--self-test":
+			opts.SelfTest = true
+		case "--receipt":
+			opts.Receipt = true
+		case "--implied-rate":
+			opts.ImpliedRate = true
+		case "--progress":
+			opts.Progress = true
+		case "--stream":
+			opts.Stream = true
+		case "--trim-zeros":
+			opts.TrimZeros = true
+		case "--rates-stdin":
+			opts.RatesStdin = true
+		case "--fail-fast":
+			opts.FailFast = true
+		case "--timeout-budget":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("неверное значение --timeout-budget: %s", value)
+			}
+			opts.TimeoutBudget = d
+		case "--dedupe":
+			opts.Dedupe = true
+		case "--holdings-format":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.HoldingsFormat = strings.ToLower(value)
+			if !isHoldingsFormat(opts.HoldingsFormat) {
+				return opts, fmt.Errorf("неизвестный формат портфеля %q (допустимо: csv, tsv, json)", value)
+			}
+		case "--verify":
+			opts.Verify = true
+		case "--verify-warn":
+			opts.Verify = true
+			opts.VerifyWarn = true
+		case "--verify-factor":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f <= 1 {
+				return opts, fmt.Errorf("неверное значение --verify-factor: %s (должно быть больше 1)", value)
+			}
+			opts.VerifyFactor = f
+		case "--magnitude-warn":
+			opts.MagnitudeWarn = true
+		case "--magnitude-threshold":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f <= 0 {
+				return opts, fmt.Errorf("неверное значение --magnitude-threshold: %s", value)
+			}
+			opts.MagnitudeWarn = true
+			opts.MagnitudeThreshold = f
+		case "--changed-only":
+			opts.ChangedOnly = true
+		case "--min-change":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			f, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || f < 0 {
+				return opts, fmt.Errorf("неверное значение --min-change: %s (нужен процент, например 0.5)", value)
+			}
+			opts.MinChange = f
+		case "--alert-above", "--alert-below":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f <= 0 {
+				return opts, fmt.Errorf("неверное значение %s: %s (нужен положительный курс)", arg, value)
+			}
+			if arg == "--alert-above" {
+				opts.AlertAbove = f
+			} else {
+				opts.AlertBelow = f
+			}
+		case "--as-fraction":
+			opts.AsFraction = true
+		case "--max-denominator":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("неверное значение --max-denominator: %s (нужно целое число от 1)", value)
+			}
+			opts.AsFraction = true
+			opts.MaxDenominator = n
+		case "--explain-rounding":
+			opts.ExplainRounding = true
+		case "--alert-repeat":
+			opts.AlertRepeat = true
+		case "--pair-notation":
+			opts.PairNotation = true
+		case "--cache-ls":
+			opts.CacheList = true
+		case "--cache-prune":
+			opts.CachePrune = true
+		case "--older-than":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("неверное значение --older-than: %s", value)
+			}
+			opts.OlderThan = d
+		case "--net-profile":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.NetProfile = value
+		case "--timeout", "--connect-timeout", "--read-timeout":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("неверное значение %s: %s", arg, value)
+			}
+			switch arg {
+			case "--timeout":
+				opts.Timeouts.Total = d
+			case "--connect-timeout":
+				opts.Timeouts.Connect = d
+			default:
+				opts.Timeouts.Read = d
+			}
+		case "--max-response-size":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			size, err := parseSize(value)
+			if err != nil || size <= 0 {
+				return opts, fmt.Errorf("неверное значение --max-response-size: %s (например, 512KB или 8MB)", value)
+			}
+			opts.MaxResponseSize = size
+		case "--yes", "-y":
+			opts.Yes = true
+		case "--large-batch-threshold":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.LargeBatchThreshold = n
+		case "--retries":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.Retries = n
+		case "--retry-idempotent-only":
+			opts.RetryIdempotentOnly = true
+		case "--prefer-fresh-within":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("неверное значение --prefer-fresh-within: %s", value)
+			}
+			opts.PreferFreshWithin = d
+		case "--target-result":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil || v <= 0 {
+				return opts, fmt.Errorf("неверное значение --target-result: %s", value)
+			}
+			opts.UseTargetResult = true
+			opts.TargetResult = v
+		case "--audit-log":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.AuditLog = value
+		case "--compare-to-mid":
+			opts.CompareToMid = true
+		case "--json-base-path", "--json-date-path", "--json-rates-path":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			if _, err := parseJSONPath(value); err != nil {
+				return opts, fmt.Errorf("неверный путь %s: %w", arg, err)
+			}
+			switch arg {
+			case "--json-base-path":
+				opts.Paths.Base = value
+			case "--json-date-path":
+				opts.Paths.Date = value
+			default:
+				opts.Paths.Rates = value
+			}
+		case "--no-color":
+			opts.NoColor = true
+		case "--no-prompt":
+			opts.NoPrompt = true
+		case "--smooth":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 2 {
+				return opts, fmt.Errorf("неверное значение --smooth: %s (нужно число дней не меньше 2)", value)
+			}
+			opts.Smooth = n
+		case "--smooth-method":
+			value, err := nextValue(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.SmoothMethod = strings.ToLower(value)
+			if !containsString(smoothMethods, opts.SmoothMethod) {
+				return opts, fmt.Errorf("неизвестный способ --smooth-method %q (допустимо: %s)",
+					value, strings.Join(smoothMethods, ", "))
+			}
+		case "--percent-precision":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.PercentPrecision = n
+		case "--max-targets":
+			n, err := nextNonNegativeInt(argv, &i)
+			if err != nil {
+				return opts, err
+			}
+			opts.MaxTargets = n
+		default:
+			opts.Args = append(opts.Args, arg)
+		}
+	}
+	if opts.ChangedOnly && !opts.All && !opts.List {
+		return opts, fmt.Errorf("--changed-only используется вместе с --all или --list")
+	}
+	if opts.FlattenTo != "" && !opts.Flatten {
+		return opts, fmt.Errorf("--to используется только вместе с --flatten")
+	}
+	return opts, nil
+}
+
+// nextValue возвращает значение флага argv[*i] и сдвигает индекс
+func nextValue(argv []string, i *int) (string, error) {
+	flag := argv[*i]
+	if *i+1 >= len(argv) {
+		return "", fmt.Errorf("флаг %s требует значение", flag)
+	}
+	*i++
+	return argv[*i], nil
+}
+
+// nextNonNegativeInt возвращает целое неотрицательное значение флага
+func nextNonNegativeInt(argv []string, i *int) (int, error) {
+	flag := argv[*i]
+	value, err := nextValue(argv, i)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("неверное значение %s: %s", flag, value)
+	}
+	return n, nil
+}
+
+func main() {
+	// Проверяем флаг --help
+	if len(os.Args) > 1 && (os.Args[1] == "--help" || os.Args[1] == "-h") {
+		printHelp()
+		return
+	}
+
+	// Проверяем флаг --history
+	if len(os.Args) > 1 && os.Args[1] == "--history" {
+		filter := ""
+		if len(os.Args) > 2 {
+			filter = strings.ToUpper(os.Args[2])
+		}
+		showHistory(filter)
+		return
+	}
+
+	// Проверяем флаг --check-config [FILE]: только проверка конфига, без конвертации
+	if len(os.Args) > 1 && os.Args[1] == "--check-config" {
+		path := configFile
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		os.Exit(runCheckConfig(path))
+	}
+
+	// Загружаем конфигурацию
+	cfg, err := loadConfig()
+	if err != nil {
+		color.Red("❌ Ошибка конфигурации: %v", err)
+		os.Exit(1)
+	}
+
+	// Разбираем флаги командной строки
+	opts, err := parseFlags(os.Args[1:])
+	if err != nil {
+		color.Red("❌ Ошибка: %v", err)
+		os.Exit(1)
+	}
+	verbose = opts.Verbose
+	if opts.NoColor {
+		color.NoColor = true
+	}
+	// Исходная валюта по умолчанию: --from > default_from (конфиг, CC_DEFAULT_FROM) > локаль > USD
+	var fromSource string
+	cfg.DefaultFrom, fromSource = defaultSourceCurrency(opts.From, cfg.DefaultFrom, cfg.Locale, systemLocale(), cfg.DefaultTo)
+	opts.StaleWarnAfter, opts.StaleAfter, _ = stalenessThresholds(cfg)
+	// Сетевой профиль: таймаут из флагов важнее таймаута профиля
+	var profile NetProfile
+	if opts.NetProfile != "" {
+		if profile, err = lookupNetProfile(cfg, opts.NetProfile); err != nil {
+			color.Red("❌ Ошибка: %v", err)
+			os.Exit(1)
+		}
+		if opts.Timeouts.Total == 0 && profile.Timeout != "" {
+			opts.Timeouts.Total, _ = parseDuration(profile.Timeout)
+		}
+	}
+	if err := checkTimeouts(opts.Timeouts); err != nil {
+		color.Red("❌ Ошибка: %v", err)
+		os.Exit(1)
+	}
+	if maxIdle, idleTimeout, _ := transportSettings(cfg); maxIdle != defaultMaxIdleConns || idleTimeout != defaultIdleConnTimeout || opts.Timeouts != (HTTPTimeouts{}) || opts.NetProfile != "" {
+		httpClient = newHTTPClient(maxIdle, idleTimeout, opts.Timeouts)
+	}
+	if err := applyNetProfile(httpClient, profile); err != nil {
+		color.Red("❌ Ошибка сетевого профиля %s: %v", opts.NetProfile, err)
+		os.Exit(1)
+	}
+	if opts.NoCache && opts.Offline {
+		color.Red("❌ Ошибка: --no-cache нельзя совмещать с --offline — оффлайн курсы берутся только из кэша")
+		os.Exit(1)
+	}
+	noCache, noCacheWrite = opts.NoCache, opts.NoCacheWrite
+	preferFreshWithin = opts.PreferFreshWithin
+	minorUnitsOverrides = normalizeMinorUnits(cfg.MinorUnits)
+	if opts.PercentPrecision >= 0 {
+		percentPrecision = opts.PercentPrecision
+	}
+	if opts.MaxResponseSize > 0 {
+		maxResponseSize = opts.MaxResponseSize
+	}
+	retryPolicy = RetryPolicy{Attempts: opts.Retries, IdempotentOnly: opts.RetryIdempotentOnly || cfg.RetryIdempotentOnly == nil || *cfg.RetryIdempotentOnly}
+	responsePaths = opts.Paths
+	if opts.RatesStdin {
+		if opts.ScanText != "" || opts.Stream {
+			color.Red("❌ Ошибка: --rates-stdin нельзя совмещать с --scan-text и --stream — они тоже читают stdin")
+			os.Exit(1)
+		}
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, maxResponseSize+1))
+		if err == nil && int64(len(data)) > maxResponseSize {
+			err = fmt.Errorf("курсы в stdin больше %s", formatSize(maxResponseSize))
+		}
+		if err == nil {
+			stdinRates, err = parseStdinRates(data, time.Now())
+		}
+		if err != nil {
+			if isMachineReadable(opts.Format) {
+				outputError(fmt.Sprintf("--rates-stdin: %v", err), opts.Format == "json")
+			} else {
+				color.Red("❌ Ошибка --rates-stdin: %v", err)
+			}
+			os.Exit(1)
+		}
+	}
+	if opts.Locale == "" {
+		opts.Locale = cfg.Locale
+	}
+	if opts.VerifyFactor == 0 {
+		opts.VerifyFactor = cfg.VerifyFactor
+	}
+	if opts.LargeBatchThreshold == 0 {
+		opts.LargeBatchThreshold = cfg.LargeBatchThreshold
+	}
+	if opts.LargeBatchThreshold == 0 {
+		opts.LargeBatchThreshold = defaultLargeBatch
+	}
+	if opts.VerifyFactor == 0 {
+		opts.VerifyFactor = defaultVerifyFactor
+	}
+	// С --verify (без -warn) отвергнутые курсы не попадают в кэш и снимки
+	if opts.Verify && !opts.VerifyWarn {
+		factor := opts.VerifyFactor
+		storeCheck = func(base string, rates *ExchangeRateResponse) bool {
+			return ratesPassVerify(loadSnapshots()[base], rates, factor)
+		}
+	}
+	if opts.MagnitudeThreshold == 0 {
+		opts.MagnitudeThreshold = cfg.MagnitudeThreshold
+	}
+	if opts.MagnitudeThreshold == 0 {
+		opts.MagnitudeThreshold = defaultMagnitude
+	}
+	if opts.Strict {
+		defer exitOnWarnings()
+	}
+	if opts.AuditLog != "" {
+		f, err := openAuditLog(opts.AuditLog)
+		if err != nil {
+			color.Red("❌ Ошибка журнала аудита: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		auditLog = f
+	}
+	args := opts.Args
+
+	// Режим --self-test: проверка ядра конвертации без сети
+	if opts.SelfTest {
+		if _, failed := runSelfTest(os.Stdout, selfTestChecks()); failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Режим --compact-rate-only: только число, без цвета; при ошибке — пустой вывод
+	if opts.CompactRateOnly {
+		rate, err := compactRate(args)
+		if err != nil {
+			os.Exit(1)
+		}
+		fmt.Println(strconv.FormatFloat(rate, 'f', opts.PrecisionRate, 64))
+		return
+	}
+
+	// Команды управления кэшем
+	if opts.CacheList {
+		printCacheList(loadCache(), time.Now())
+		return
+	}
+	if opts.CachePrune {
+		if opts.OlderThan == 0 {
+			color.Red("❌ Использование: %s --cache-prune --older-than DURATION (например, 72h или 7d)", os.Args[0])
+			os.Exit(1)
+		}
+		cache := loadCache()
+		removed := pruneCache(cache, opts.OlderThan, time.Now())
+		if len(removed) > 0 {
+			saveCache(cache)
+		}
+		color.Green("🧹 Удалено записей кэша: %d %s", len(removed), strings.Join(removed, " "))
+		return
+	}
+
+	// Команды управления базовой суммой для --percent
+	if opts.SetBaseAmount {
+		if len(args) != 2 {
+			color.Red("❌ Использование: %s --set-base-amount <amount> <currency>", os.Args[0])
+			os.Exit(1)
+		}
+		baseAmount, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || baseAmount <= 0 {
+			color.Red("❌ Ошибка: неверная сумма")
+			os.Exit(1)
+		}
+		base := BaseAmount{Amount: baseAmount, Currency: strings.ToUpper(args[1])}
+		if err := saveBaseAmount(base); err != nil {
+			color.Red("❌ Ошибка сохранения базовой суммы: %v", err)
+			os.Exit(1)
+		}
+		color.Green("✅ Базовая сумма сохранена: %.2f %s", base.Amount, base.Currency)
+		return
+	}
+	if opts.ClearBaseAmount {
+		if err := os.Remove(baseFile); err != nil && !os.IsNotExist(err) {
+			color.Red("❌ Ошибка удаления базовой суммы: %v", err)
+			os.Exit(1)
+		}
+		color.Green("✅ Сохранённая базовая сумма удалена")
+		return
+	}
+
+	// Флаг формата перебивает формат вывода из конфига
+	outputFormat := resolveOutputFormat(opts.Format, cfg.OutputFormat)
+	// --trim-zeros касается только текста и таблиц: в машинных форматах числа остаются как есть
+	trimZeros = opts.TrimZeros && !isMachineReadable(outputFormat)
+	jsonOutput := outputFormat == "json"
+	csvOutput := outputFormat == "csv"
+	tableOutput := outputFormat == "table"
+	markdownOutput := outputFormat == "markdown"
+	invoiceOutput := outputFormat == "invoice"
+	fixedOutput := outputFormat == "fixed"
+	quiet := isMachineReadable(outputFormat) || opts.ScanText != "" || opts.Stream
+
+	if !quiet {
+		printHeader()
+	}
+
+	// Режим --info: справочные данные валюты и её курс к базовой
+	if opts.Info != "" {
+		code, _, err := resolveCurrencyInput(opts.Info, cfg.SymbolPrecedence)
+		if err != nil {
+			if jsonOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		base := cfg.DefaultFrom
+		if code == base {
+			base = cfg.DefaultTo
+		}
+		if !quiet && !opts.Offline && !opts.RatesStdin {
+			color.Cyan("🔄 Загрузка актуальных курсов валют...")
+		}
+		rates, err := getExchangeRates(base, true, opts.Offline)
+		if err != nil {
+			addWarning("курс %s/%s недоступен: %v", base, code, err)
+			rates = nil
+		}
+		info, err := currencyDetails(code, base, rates)
+		if err != nil {
+			if jsonOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		if jsonOutput {
+			data, _ := json.MarshalIndent(info, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			printCurrencyDetails(info, opts)
+		}
+		return
+	}
+
+	// Режим --scan-text: цены в тексте из stdin дополняются суммой в целевой валюте
+	if opts.ScanText != "" {
+		target, _, err := resolveCurrencyInput(opts.ScanText, cfg.SymbolPrecedence)
+		if err == nil {
+			_, err = lookupCurrency(target)
+		}
+		if err != nil {
+			color.Red("❌ Ошибка: %v", err)
+			os.Exit(1)
+		}
+		text, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			color.Red("❌ Ошибка чтения stdin: %v", err)
+			os.Exit(1)
+		}
+		rates, err := getExchangeRates(target, true, opts.Offline)
+		if err != nil {
+			color.Red("❌ Ошибка при получении курсов: %v", err)
+			os.Exit(1)
+		}
+		fmt.Print(scanText(string(text), target, rates, cfg.SymbolPrecedence, opts))
+		return
+	}
+
+	// Режим --top-movers: наибольшие изменения курсов по сохранённым снимкам
+	if opts.TopMovers {
+		base := cfg.DefaultFrom
+		if len(args) > 0 {
+			base = strings.ToUpper(args[0])
+		}
+		since := time.Now().AddDate(0, 0, -opts.Days)
+		movers, oldest, newest, err := topMovers(loadSnapshots()[base], since)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		limit := opts.MaxTargets
+		if limit == 0 {
+			limit = defaultTopMovers
+		}
+		if len(movers) > limit {
+			movers = movers[:limit]
+		}
+		if jsonOutput {
+			data, _ := json.MarshalIndent(map[string]any{
+				"success": true,
+				"base":    base,
+				"from":    oldest.Date,
+				"to":      newest.Date,
+				"movers":  movers,
+			}, "", "  ")
+			fmt.Println(string(data))
+		} else if csvOutput {
+			writeMoversCSV(os.Stdout, movers)
+		} else {
+			printTopMovers(base, movers, oldest, newest, opts.Locale)
+		}
+		return
+	}
+
+	// Режим --compare-dates: изменение курса пары между двумя датами по снимкам (<from> <to>)
+	if opts.CompareDates[0] != "" {
+		if len(args) != 2 {
+			if jsonOutput || csvOutput {
+				outputError("неверное количество аргументов", jsonOutput)
+			} else {
+				color.Red("❌ Использование: %s --compare-dates <date1> <date2> <from> <to>", os.Args[0])
+			}
+			os.Exit(1)
+		}
+		var to CurrencyInfo
+		from, err := lookupCurrency(args[0])
+		if err == nil {
+			to, err = lookupCurrency(args[1])
+		}
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка: %v", err)
+			}
+			os.Exit(1)
+		}
+		cmp, err := compareDates(loadSnapshots()[from.Code], from.Code, to.Code, opts.CompareDates[0], opts.CompareDates[1])
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		if jsonOutput {
+			data, _ := json.MarshalIndent(map[string]any{"success": true, "comparison": cmp}, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			for _, line := range cmp.Lines(opts) {
+				color.Cyan("%s", line)
+			}
+		}
+		return
+	}
+
+	// Режим --portfolio: стоимость позиций портфеля в целевой валюте
+	if opts.Portfolio != "" {
+		if invoiceOutput {
+			color.Red("❌ Формат invoice не поддерживается в --portfolio: используйте text, table, markdown, fixed, json или csv")
+			os.Exit(1)
+		}
+		target := cfg.DefaultTo
+		if len(args) > 0 {
+			target = strings.ToUpper(args[0])
+		}
+		holdings, err := loadHoldings(opts.Portfolio, opts.HoldingsFormat)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка чтения портфеля: %v", err)
+			}
+			os.Exit(1)
+		}
+		if err := confirmLargeBatch(len(holdings), 1, opts, canPrompt(opts.NoPrompt, stdinIsTerminal()), askConfirmation); err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		if !quiet && !opts.Offline && !opts.RatesStdin {
+			color.Cyan("🔄 Загрузка актуальных курсов валют...")
+		}
+		rates, err := getExchangeRates(target, quiet, opts.Offline)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка при получении курсов: %v", err)
+			}
+			os.Exit(1)
+		}
+		progress := newProgressBar(len(holdings), os.Stderr, opts.Progress && !quiet && stderrIsTerminal())
+		values, total, err := valueHoldings(holdings, rates, progress)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		if jsonOutput {
+			data, _ := json.MarshalIndent(map[string]any{
+				"success":  true,
+				"currency": target,
+				"holdings": values,
+				"total":    total,
+			}, "", "  ")
+			fmt.Println(string(data))
+		} else if csvOutput {
+			// currency,amount,value,rate
+			for _, v := range values {
+				fmt.Printf("%s,%.2f,%.2f,%.6f\n", v.Currency, v.Amount, v.Value, v.Rate)
+			}
+		} else if markdownOutput {
+			fmt.Print(renderMarkdownPortfolio(values, total, opts))
+		} else if fixedOutput {
+			for _, v := range values {
+				fmt.Println(fixedLine(v.Amount, v.Currency, target, v.Value, v.Rate, opts))
+			}
+		} else {
+			printPortfolio(target, values, total, rates, opts.Locale)
+			if opts.ExplainRounding {
+				printRoundingTrace(portfolioRounding(values, total, target), opts.Locale)
+			}
+		}
+		return
+	}
+
+	// Режим --batch: пакетная конвертация строк amount,from,to из CSV
+	if opts.Batch != "" {
+		if invoiceOutput {
+			color.Red("❌ Формат invoice не поддерживается в --batch: используйте text, table, markdown, fixed, json или csv")
+			os.Exit(1)
+		}
+		data, err := os.ReadFile(opts.Batch)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка чтения пакета: %v", err)
+			}
+			os.Exit(1)
+		}
+		rows, err := parseBatch(data)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка чтения пакета: %v", err)
+			}
+			os.Exit(1)
+		}
+		if opts.Dedupe {
+			rows = dedupeBatch(rows)
+		}
+		if err := confirmLargeBatch(len(rows), batchSources(rows), opts, canPrompt(opts.NoPrompt, stdinIsTerminal()), askConfirmation); err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		if !quiet && !opts.Offline && !opts.RatesStdin {
+			color.Cyan("🔄 Загрузка актуальных курсов валют...")
+		}
+		fetch := func(base string) (*ExchangeRateResponse, error) {
+			return getExchangeRates(base, true, opts.Offline)
+		}
+		progress := newProgressBar(len(rows), os.Stderr, opts.Progress && !quiet && stderrIsTerminal())
+		ctx := context.Background()
+		if opts.TimeoutBudget > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.TimeoutBudget)
+			defer cancel()
+			requestContext = ctx
+		}
+		results := runBatch(ctx, rows, fetch, newCurrencyMetaCache(), progress, opts.FailFast)
+		budgetExceeded := ctx.Err() != nil && len(results) < len(rows)
+		sortBatchResults(results, opts.OutputSort)
+		failed := 0
+		for _, r := range results {
+			if r.Error != "" {
+				failed++
+				addWarning("строка %d: %s", r.Line, r.Error)
+			}
+		}
+		skipped := len(rows) - len(results)
+		if jsonOutput {
+			data, _ := json.MarshalIndent(map[string]any{
+				"success":         failed == 0 && !budgetExceeded,
+				"failed":          failed,
+				"skipped":         skipped,
+				"budget_exceeded": budgetExceeded,
+				"results":         results,
+			}, "", "  ")
+			fmt.Println(string(data))
+		} else if csvOutput {
+			writeBatchCSV(os.Stdout, results, opts.Dedupe)
+		} else if markdownOutput {
+			fmt.Print(renderMarkdownBatch(results, opts))
+		} else if fixedOutput {
+			// Строки с ошибкой в fixed не выводятся: они попадают в предупреждения и код возврата
+			for _, r := range results {
+				if r.Error == "" {
+					fmt.Println(fixedLine(r.Amount, r.From, r.To, r.Result, r.Rate, opts))
+				}
+			}
+		} else {
+			printBatch(results, opts)
+			if budgetExceeded {
+				color.Red("  --timeout-budget: бюджет %s исчерпан, обработано строк: %d, пропущено: %d", opts.TimeoutBudget, len(results), skipped)
+			} else if skipped > 0 {
+				color.Red("  --fail-fast: прогон остановлен на первой ошибке, не обработано строк: %d", skipped)
+			}
+		}
+		// Строки с ошибкой не прерывают прогон, но код возврата сообщает о сбое
+		if failed > 0 || budgetExceeded {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Режим --stream: суммы построчно из stdin для одной пары (<from> <to>)
+	if opts.Stream {
+		if len(args) != 2 {
+			color.Red("❌ Использование: %s --stream <from> <to> < amounts.txt", os.Args[0])
+			os.Exit(1)
+		}
+		from, err := lookupCurrency(args[0])
+		if err == nil {
+			_, err = lookupCurrency(args[1])
+		}
+		if err != nil {
+			color.Red("❌ Ошибка: %v", err)
+			os.Exit(1)
+		}
+		to := strings.ToUpper(strings.TrimSpace(args[1]))
+		fetch := func() (*ExchangeRateResponse, error) {
+			return getExchangeRates(from.Code, true, opts.Offline)
+		}
+		holder, err := newRatesHolder(fetch)
+		if err != nil {
+			color.Red("❌ Ошибка при получении курсов: %v", err)
+			os.Exit(1)
+		}
+		if _, ok := holder.Get().Rates[to]; !ok {
+			color.Red("❌ Ошибка: курс %s не найден", to)
+			os.Exit(1)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		// refreshDone закрывается, когда фоновое обновление остановилось: до этого
+		// нельзя читать warnings и завершать процесс, иначе запись кэша оборвётся
+		refreshDone := make(chan struct{})
+		if !opts.Offline && stdinRates == nil {
+			go func() {
+				defer close(refreshDone)
+				holder.RefreshEvery(ctx, cacheTTL, func(err error) {
+					color.New(color.FgYellow).Fprintf(os.Stderr, "⚠️  Не удалось обновить курсы, используются прежние: %v\n", err)
+				})
+			}()
+		} else {
+			close(refreshDone)
+		}
+		_, failed := streamConvert(os.Stdin, os.Stdout, os.Stderr, from.Code, to, holder.Get, resultDecimals(to, opts.Whole))
+		cancel()
+		<-refreshDone
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Режим --flatten: все закэшированные таблицы в одной базе
+	if opts.Flatten {
+		base := opts.FlattenTo
+		if base == "" {
+			base = cfg.DefaultFrom
+		}
+		flat, skipped, err := flattenCache(loadCache(), base)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		for _, b := range skipped {
+			addWarning("таблица %s пропущена: в ней нет курса %s", b, base)
+		}
+		switch {
+		case opts.Export != "":
+			f, err := os.Create(opts.Export)
+			if err == nil {
+				err = writeFlatCSV(f, flat)
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err != nil {
+				color.Red("❌ Ошибка экспорта: %v", err)
+				os.Exit(1)
+			}
+			if !quiet {
+				color.Green("✅ Записано валют: %d (база %s) в %s", len(flat), base, opts.Export)
+			}
+		case jsonOutput:
+			data, _ := json.MarshalIndent(map[string]any{"success": true, "base": base, "rates": flat}, "", "  ")
+			fmt.Println(string(data))
+		case csvOutput:
+			writeFlatCSV(os.Stdout, flat)
+		default:
+			printFlatRates(base, flat, opts.Locale)
+		}
+		if !quiet {
+			for _, b := range skipped {
+				color.Yellow("⚠️  Таблица %s пропущена: в ней нет курса %s", b, base)
+			}
+		}
+		return
+	}
+
+	// Режим --list: все курсы для базовой валюты
+	if opts.List {
+		base := cfg.DefaultFrom
+		if len(args) > 0 {
+			base = strings.ToUpper(args[0])
+		}
+		if !quiet && !opts.Offline && !opts.RatesStdin {
+			color.Cyan("🔄 Загрузка актуальных курсов валют...")
+		}
+		rates, err := getExchangeRates(base, quiet, opts.Offline)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка при получении курсов: %v", err)
+			}
+			os.Exit(1)
+		}
+		codes := sortedCurrencies(rates)
+		var changes []string
+		if opts.ChangedOnly {
+			var previous map[string]float64
+			codes, previous = filterChanged(codes, base, rates, opts.MinChange, quiet)
+			for _, code := range codes {
+				changes = append(changes, snapshotChangeMessage(code, rates.Rates[code], previous[code], opts.Locale))
+			}
+		}
+		shown, omitted := limitTargets(codes, opts.MaxTargets)
+		listed := *rates
+		listed.Rates = make(map[string]float64, len(shown))
+		for _, code := range shown {
+			listed.Rates[code] = rates.Rates[code]
+		}
+		if jsonOutput {
+			outputRatesJSON(base, &listed)
+		} else if csvOutput {
+			outputRatesCSV(&listed)
+		} else if markdownOutput {
+			fmt.Print(renderMarkdownRates(&listed))
+		} else {
+			printRatesList(base, &listed, opts.Locale)
+			for _, line := range changes {
+				color.Cyan("  %s", line)
+			}
+			printOmittedNote(omitted, quiet)
+			printCurrenciesSummary(rates)
+		}
+		if quiet {
+			printOmittedNote(omitted, quiet)
+		}
+		return
+	}
+
+	// Режим --all: конвертация во все доступные валюты (<from> <amount>)
+	if opts.All {
+		if len(args) != 2 {
+			if jsonOutput || csvOutput {
+				outputError("неверное количество аргументов", jsonOutput)
+			} else {
+				color.Red("❌ Использование: %s --all <from> <amount>", os.Args[0])
+			}
+			os.Exit(1)
+		}
+		args = []string{args[0], "", args[1]}
+	}
+
+	// Режим --implied-rate: курс по известным суммам и сравнение с рыночным
+	if opts.ImpliedRate {
+		if len(args) != 4 {
+			if jsonOutput || csvOutput {
+				outputError("неверное количество аргументов", jsonOutput)
+			} else {
+				color.Red("❌ Использование: %s --implied-rate <from> <to> <source_amount> <target_amount>", os.Args[0])
+			}
+			os.Exit(1)
+		}
+		from, to := strings.ToUpper(args[0]), strings.ToUpper(args[1])
+		source, errSource := strconv.ParseFloat(args[2], 64)
+		target, errTarget := strconv.ParseFloat(args[3], 64)
+		if errSource != nil || errTarget != nil {
+			if jsonOutput || csvOutput {
+				outputError("неверный формат суммы", jsonOutput)
+			} else {
+				color.Red("❌ Неверный формат суммы")
+			}
+			os.Exit(1)
+		}
+		implied, err := impliedRate(source, target)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		if !quiet && !opts.Offline && !opts.RatesStdin {
+			color.Cyan("🔄 Загрузка актуальных курсов валют...")
+		}
+		rates, err := getExchangeRates(from, quiet, opts.Offline)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка при получении курсов: %v", err)
+			}
+			os.Exit(1)
+		}
+		market, ok := rates.Rates[to]
+		if !ok || market == 0 {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("валюта %s не найдена", to), jsonOutput)
+			} else {
+				color.Red("❌ Валюта %s не найдена", to)
+			}
+			os.Exit(1)
+		}
+		diff := (implied - market) / market * 100
+		if jsonOutput {
+			data, _ := json.MarshalIndent(map[string]any{
+				"success":       true,
+				"from":          from,
+				"to":            to,
+				"source_amount": source,
+				"target_amount": target,
+				"implied_rate":  implied,
+				"market_rate":   market,
+				"diff_percent":  diff,
+			}, "", "  ")
+			fmt.Println(string(data))
+		} else if csvOutput {
+			// from,to,source_amount,target_amount,implied_rate,market_rate,diff_percent
+			fmt.Printf("%s,%s,%.2f,%.2f,%.6f,%.6f,%.4f\n", from, to, source, target, implied, market, diff)
+		} else {
+			num := func(value float64) string { return formatNumber(value, opts.PrecisionRate, opts.Locale) }
+			fmt.Println()
+			color.Green("Подразумеваемый курс: 1 %s = %s %s (%s / %s)", from, num(implied), to,
+				formatNumber(target, 2, opts.Locale), formatNumber(source, 2, opts.Locale))
+			color.Cyan("Рыночный курс:        1 %s = %s %s", from, num(market), to)
+			color.Cyan("Отклонение от рынка: %s", formatPercent(diff, true))
+			fmt.Println()
+		}
+		return
+	}
+
+	// Режим --target-result: сколько исходной валюты нужно для заданной суммы
+	if opts.UseTargetResult {
+		if len(args) != 2 {
+			if jsonOutput || csvOutput {
+				outputError("неверное количество аргументов", jsonOutput)
+			} else {
+				color.Red("❌ Использование: %s --target-result <amount> <from> <to>", os.Args[0])
+			}
+			os.Exit(1)
+		}
+		from, to := strings.ToUpper(args[0]), strings.ToUpper(args[1])
+		if !quiet && !opts.Offline && !opts.RatesStdin {
+			color.Cyan("🔄 Загрузка актуальных курсов валют...")
+		}
+		rates, err := getExchangeRates(from, quiet, opts.Offline)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка при получении курсов: %v", err)
+			}
+			os.Exit(1)
+		}
+		rate := rates.Rates[to]
+		required, err := requiredAmount(opts.TargetResult, rate)
+		if err != nil {
+			if _, ok := rates.Rates[to]; !ok {
+				err = fmt.Errorf("валюта %s не найдена", to)
+			}
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ %v", err)
+			}
+			os.Exit(1)
+		}
+		updateTime := time.Unix(rates.TimeLastUpdated, 0)
+		recordAudit(from, to, required, opts.TargetResult, rate, rates)
+		if jsonOutput {
+			outputJSON(from, to, required, opts.TargetResult, rate, rates)
+		} else if csvOutput {
+			outputCSV(from, to, required, opts.TargetResult, rate, updateTime)
+		} else {
+			fmt.Println()
+			color.Green("Чтобы получить %s %s, нужно %s %s", formatNumber(opts.TargetResult, 2, opts.Locale), to,
+				formatNumber(required, 2, opts.Locale), from)
+			color.Cyan("%s", rateLines(from, to, rate, opts)[0])
+			fmt.Println()
+		}
+		return
+	}
+
+	// Режим --percent <to>: исходная валюта и сумма берутся из базовой суммы
+	if opts.UsePercent && len(args) == 1 {
+		base, ok := loadBaseAmount(cfg)
+		if !ok {
+			if jsonOutput || csvOutput {
+				outputError("базовая сумма не задана", jsonOutput)
+			} else {
+				color.Red("❌ Базовая сумма не задана — используйте --set-base-amount <amount> <currency>")
+			}
+			os.Exit(1)
+		}
+		args = []string{base.Currency, args[0], strconv.FormatFloat(base.Amount, 'f', -1, 64)}
+	}
+
+	// Получаем параметры из командной строки или интерактивно
+	var fromCurrency, toCurrencyRaw string
+	var amount float64
+
+	// Вызов <to> <amount>: исходная валюта берётся по умолчанию, и это сообщается
+	if len(args) == 2 {
+		if !quiet {
+			color.HiBlack("ℹ️  Исходная валюта не указана: используется %s (%s)", cfg.DefaultFrom, fromSource)
+		}
+		args = append([]string{cfg.DefaultFrom}, args...)
+	}
+
+	if len(args) == 3 {
+		// Режим с аргументами командной строки
+		var err error
+		fromCurrency, _, err = resolveCurrencyInput(args[0], cfg.SymbolPrecedence)
+		if err == nil {
+			toCurrencyRaw, _, err = resolveCurrencyList(args[1], cfg.SymbolPrecedence)
+		}
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(err.Error(), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка: %v", err)
+			}
+			os.Exit(1)
+		}
+		amount, err = strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError("неверная сумма", jsonOutput)
+			} else {
+				color.Red("❌ Ошибка: неверная сумма")
+			}
+			os.Exit(1)
+		}
+	} else if len(args) == 0 {
+		// Без терминала или с --no-prompt не ждём ввода, а завершаемся с ошибкой
+		if !canPrompt(opts.NoPrompt, stdinIsTerminal()) {
+			if jsonOutput || csvOutput {
+				outputError("не указаны аргументы <from> <to> <amount>, интерактивный ввод отключён", jsonOutput)
+			} else {
+				color.Red("❌ Не указаны аргументы <from> <to> <amount>, интерактивный ввод отключён")
+			}
+			os.Exit(exitMissingInput)
+		}
+		// Интерактивный режим с подсказками из конфига
+		if !quiet {
+			color.HiBlack("ℹ️  Исходная валюта по умолчанию: %s (%s)", cfg.DefaultFrom, fromSource)
+		}
+		// Перед запросом показываем сводку; при отказе ввод повторяется с прежними значениями
+		fromDef, toDef, edited := cfg.DefaultFrom, cfg.DefaultTo, false
+		for {
+			fromCurrency = askCurrency(promptText(cfg.PromptFrom, defaultPromptFrom, fromDef), fromDef, cfg.SymbolPrecedence)
+			toCurrencyRaw = askCurrency(promptText(cfg.PromptTo, defaultPromptTo, toDef), toDef, cfg.SymbolPrecedence)
+			if edited {
+				amount = getAmountOr(promptText(cfg.PromptAmount, defaultPromptAmountEdit, strconv.FormatFloat(amount, 'f', -1, 64)), amount)
+			} else {
+				amount = getAmount(promptText(cfg.PromptAmount, defaultPromptAmount, ""))
+			}
+			if opts.NoPreview {
+				break
+			}
+			color.Cyan("%s", previewText(fromCurrency, toCurrencyRaw, amount, opts))
+			if previewAccepted(getInput("Продолжить? [Y/n] (n — изменить ввод): ")) {
+				break
+			}
+			fromDef, toDef, edited = fromCurrency, toCurrencyRaw, true
+		}
+	} else {
+		if jsonOutput || csvOutput {
+			outputError("неверное количество аргументов", jsonOutput)
+		} else {
+			color.Red("❌ Использование: %s [--json|--csv] <from> <to1[,to2,...]> <amount>", os.Args[0])
+			color.Red("   или: %s --history", os.Args[0])
+		}
+		os.Exit(1)
+	}
+
+	// С --percent конвертируется указанный процент от суммы
+	if opts.UsePercent {
+		amount = percentOf(amount, opts.Percent)
+	}
+
+	// Разбиваем целевые валюты (поддержка USD RUB,EUR,CNY 100)
+	toCurrencies := strings.Split(toCurrencyRaw, ",")
+
+	// Получаем курсы валют
+	if !quiet && !opts.Offline && !opts.RatesStdin {
+		color.Cyan("🔄 Загрузка актуальных курсов валют...")
+	}
+	rates, err := getExchangeRates(fromCurrency, quiet, opts.Offline, nonEmptyCodes(toCurrencies)...)
+	if err != nil {
+		if jsonOutput || csvOutput {
+			outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
+		} else {
+			color.Red("❌ Ошибка при получении курсов: %v", err)
+		}
+		os.Exit(1)
+	}
+
+	updateTime := time.Unix(rates.TimeLastUpdated, 0)
+
+	// В режиме --all целевые валюты — все валюты из ответа API
+	var previousRates map[string]float64
+	if opts.All {
+		toCurrencies = sortedCurrencies(rates)
+		if opts.ChangedOnly {
+			toCurrencies, previousRates = filterChanged(toCurrencies, fromCurrency, rates, opts.MinChange, quiet)
+		}
+	}
+
+	// Ограничиваем число целевых валют (--max-targets) после упорядочивания
+	var omittedTargets int
+	toCurrencies = sortTargets(nonEmptyCodes(toCurrencies), rates, opts.OutputSort)
+	toCurrencies, omittedTargets = limitTargets(toCurrencies, opts.MaxTargets)
+
+	// Проверяем курсы на аномалии относительно предыдущего снимка (--verify)
+	if opts.Verify {
+		reference, ok := referenceSnapshot(loadSnapshots()[fromCurrency], rates)
+		if !ok {
+			if !quiet {
+				color.HiBlack("ℹ️  --verify: нет предыдущего снимка курсов %s для сравнения", fromCurrency)
+			}
+		} else if anomalies := findAnomalies(rates.Rates, reference.Rates, toCurrencies, opts.VerifyFactor); len(anomalies) > 0 {
+			for _, a := range anomalies {
+				msg := fmt.Sprintf("подозрительный курс %s/%s: %.6f (в снимке от %s: %.6f)",
+					fromCurrency, a.Currency, a.NewRate, reference.Date, a.OldRate)
+				if opts.VerifyWarn {
+					addWarning("%s", msg)
+					if !quiet {
+						color.Yellow("⚠️  %s", msg)
+					}
+				} else if jsonOutput || csvOutput {
+					outputError(msg, jsonOutput)
+				} else {
+					color.Red("❌ %s", msg)
+				}
+			}
+			if !opts.VerifyWarn {
+				os.Exit(1)
+			}
+		}
+	}
+
+	// С --smooth конвертируем по сглаженному курсу за последние N дней снимков
+	if opts.Smooth > 0 {
+		method := opts.SmoothMethod
+		if method == "" {
+			method = "median"
+		}
+		window := snapshotsSince(loadSnapshots()[fromCurrency], time.Now().AddDate(0, 0, -(opts.Smooth-1)))
+		smoothed, samples, fallback := smoothRates(rates, window, toCurrencies, method)
+		rates = smoothed
+		for _, code := range fallback {
+			addWarning("недостаточно снимков курса %s/%s за %d дн. для --smooth, используется спотовый курс", fromCurrency, code, opts.Smooth)
+		}
+		if !quiet {
+			color.HiBlack("📉 Сглаживание: %s курса за %d дн. (снимков: %d)", smoothMethodName(method), opts.Smooth, samples)
+			for _, code := range fallback {
+				color.Yellow("⚠️  %s/%s: недостаточно снимков, используется спотовый курс", fromCurrency, code)
+			}
+		}
+	}
+
+	// Режим --via: конвертация цепочкой через промежуточную валюту
+	if opts.Via != "" {
+		viaRates, err := getExchangeRates(opts.Via, quiet, opts.Offline)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("ошибка при получении курсов: %v", err), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка при получении курсов %s: %v", opts.Via, err)
+			}
+			os.Exit(1)
+		}
+		for _, toCurrency := range toCurrencies {
+			rate1, ok1 := rates.Rates[opts.Via]
+			rate2, ok2 := viaRates.Rates[toCurrency]
+			if !ok1 || !ok2 {
+				missing := opts.Via
+				if ok1 {
+					missing = toCurrency
+				}
+				if jsonOutput || csvOutput {
+					outputError(fmt.Sprintf("ошибка конвертации: валюта %s не найдена", missing), jsonOutput)
+				} else {
+					color.Red("❌ Ошибка конвертации для %s: валюта %s не найдена", toCurrency, missing)
+				}
+				addWarning("пропущена валюта %s: валюта %s не найдена", toCurrency, missing)
+				continue
+			}
+			chain := convertChain(amount, rate1, rate2, opts.RoundIntermediate)
+			saveToHistory(fromCurrency, toCurrency, amount, chain.Result, chain.EffectiveRate, updateTime)
+			recordAudit(fromCurrency, toCurrency, amount, chain.Result, chain.EffectiveRate, rates)
+			if jsonOutput {
+				outputJSON(fromCurrency, toCurrency, amount, chain.Result, chain.EffectiveRate, rates)
+			} else if csvOutput {
+				outputCSV(fromCurrency, toCurrency, amount, chain.Result, chain.EffectiveRate, updateTime)
+			} else if invoiceOutput {
+				fmt.Println(invoiceLine(amount, fromCurrency, chain.Result, toCurrency, chain.EffectiveRate, rateDate(rates), opts))
+			} else if fixedOutput {
+				fmt.Println(fixedLine(amount, fromCurrency, toCurrency, chain.Result, chain.EffectiveRate, opts))
+			} else {
+				printChainResult(amount, fromCurrency, opts.Via, toCurrency, chain, opts.RoundIntermediate, opts.Locale)
+				if opts.ExplainRounding {
+					steps := []RoundingStep{}
+					if opts.RoundIntermediate {
+						steps = append(steps, traceRounding("промежуточная сумма, "+opts.Via, amount*chain.Rate1, 2))
+					}
+					steps = append(steps, traceRounding("результат, "+toCurrency, chain.Result, 2))
+					printRoundingTrace(steps, opts.Locale)
+				}
+			}
+		}
+		return
+	}
+
+	// Для --since-last-run читаем историю до записи новых результатов
+	var prevHistory []ConversionRecord
+	changed := 0
+	if opts.SinceLastRun {
+		prevHistory = loadHistory()
+	}
+
+	// Для табличного режима и Markdown собираем все результаты, затем выводим таблицу
+	if tableOutput || markdownOutput {
+		var rows []TableRow
+		var deltas, changes []string
+		var deltaColors []color.Attribute
+		for _, toCurrency := range toCurrencies {
+			toCurrency = strings.TrimSpace(toCurrency)
+			if toCurrency == "" {
+				continue
+			}
+			result, err := convertCurrency(amount, fromCurrency, toCurrency, rates)
+			if err != nil {
+				color.Red("❌ Ошибка конвертации для %s: %v", toCurrency, err)
+				addWarning("пропущена валюта %s: %v", toCurrency, err)
+				continue
+			}
+			rate := rates.Rates[toCurrency]
+			var prev ConversionRecord
+			var found bool
+			if opts.SinceLastRun {
+				prev, found = lastRecordForPair(prevHistory, fromCurrency, toCurrency)
+			}
+			saveToHistory(fromCurrency, toCurrency, amount, result, rate, updateTime)
+			recordAudit(fromCurrency, toCurrency, amount, result, rate, rates)
+			if opts.OnlyChanged && !rateChanged(prev, found, rate) {
+				continue
+			}
+			if opts.SinceLastRun {
+				changed++
+				deltas = append(deltas, fmt.Sprintf("%s: %s", toCurrency, sinceLastRunMessage(prev, found, rate, time.Now())))
+				deltaColors = append(deltaColors, deltaColor(prev, found, rate, opts.ColorDelta))
+				changes = append(changes, sinceLastRunCell(prev, found, rate))
+			}
+			rows = append(rows, TableRow{toCurrency, result, rate})
+		}
+		if opts.OnlyChanged && len(rows) == 0 {
+			return
+		}
+		if markdownOutput {
+			fmt.Print(renderMarkdownTable(rows, opts.Whole, opts.PrecisionRate, changes))
+			printOmittedNote(omittedTargets, quiet)
+			ringBell(changed, opts)
+			return
+		}
+		printTable(amount, fromCurrency, rows, rates, opts)
+		printOmittedNote(omittedTargets, quiet)
+		if opts.Hold {
+			for _, row := range rows {
+				printHoldSimulation(amount, fromCurrency, row.Currency, row.Rate, opts)
+			}
+		}
+		for i, delta := range deltas {
+			color.New(deltaColors[i]).Printf("  %s\n", delta)
+		}
+		if opts.All {
+			printCurrenciesSummary(rates)
+		}
+		ringBell(changed, opts)
+		return
+	}
+
+	// С --align ширина чисел считается заранее по всем целевым валютам
+	if opts.Align {
+		opts.ResultWidth, opts.RateWidth = alignWidths(amount, toCurrencies, rates, opts)
+	}
+
+	// Выполняем конвертацию для каждой валюты
+	for _, toCurrency := range toCurrencies {
+		toCurrency = strings.TrimSpace(toCurrency)
+		if toCurrency == "" {
+			continue
+		}
+
+		result, err := convertCurrency(amount, fromCurrency, toCurrency, rates)
+		if err != nil {
+			if jsonOutput || csvOutput {
+				outputError(fmt.Sprintf("ошибка конвертации: %v", err), jsonOutput)
+			} else {
+				color.Red("❌ Ошибка конвертации для %s: %v", toCurrency, err)
+			}
+			addWarning("пропущена валюта %s: %v", toCurrency, err)
+			continue
+		}
+
+		rate := rates.Rates[toCurrency]
+		delta := ""
+		deltaAttr := color.FgCyan
+		var prev ConversionRecord
+		var found bool
+		if opts.SinceLastRun {
+			prev, found = lastRecordForPair(prevHistory, fromCurrency, toCurrency)
+			delta = sinceLastRunMessage(prev, found, rate, time.Now())
+			deltaAttr = deltaColor(prev, found, rate, opts.ColorDelta)
+		}
+		saveToHistory(fromCurrency, toCurrency, amount, result, rate, updateTime)
+		recordAudit(fromCurrency, toCurrency, amount, result, rate, rates)
+		if opts.OnlyChanged && !rateChanged(prev, found, rate) {
+			continue
+		}
+		changed++
+
+		var receipt Receipt
+		if opts.Receipt {
+			receipt = newReceipt(fromCurrency, toCurrency, amount, result, rate, rates)
+		}
+
+		if jsonOutput {
+			output := jsonResult(fromCurrency, toCurrency, amount, result, rate, rates)
+			if opts.Receipt {
+				output.ReceiptID = receipt.ID
+				output.Timestamp = receipt.Timestamp
+			}
+			printJSON(output)
+		} else if csvOutput {
+			outputCSV(fromCurrency, toCurrency, amount, result, rate, updateTime)
+		} else if invoiceOutput {
+			fmt.Println(invoiceLine(amount, fromCurrency, result, toCurrency, rate, rateDate(rates), opts))
+		} else if fixedOutput {
+			fmt.Println(fixedLine(amount, fromCurrency, toCurrency, result, rate, opts))
+		} else if opts.Receipt {
+			fmt.Print(renderReceipt(receipt, opts))
+		} else {
+			printResult(amount, fromCurrency, result, toCurrency, rates, opts)
+			if previous, ok := previousRates[toCurrency]; ok {
+				color.Cyan("%s", snapshotChangeMessage(toCurrency, rate, previous, opts.Locale))
+			}
+			if delta != "" {
+				color.New(deltaAttr).Printf("%s\n", delta)
+			}
+			if opts.Hold {
+				printHoldSimulation(amount, fromCurrency, toCurrency, rate, opts)
+			}
+			if opts.CompareToMid {
+				printMidQuote(toCurrency, rates, rate, opts)
+			}
+			if opts.Then != "" {
+				for _, line := range thenVsNow(amount, fromCurrency, toCurrency, rate, rateDate(rates), loadSnapshots()[fromCurrency], opts) {
+					color.Cyan("%s", line)
+				}
+			}
+			if opts.MagnitudeWarn {
+				if hint := magnitudeHint(result, opts.MagnitudeThreshold, toCurrency); hint != "" {
+					color.Yellow("%s", hint)
+				}
+			}
+		}
+	}
+
+	printOmittedNote(omittedTargets, quiet)
+	if opts.All && !quiet {
+		printCurrenciesSummary(rates)
+	}
+	if !quiet {
+		ringBell(changed, opts)
+	}
+
+	// Оповещения о пересечении порогов; состояние хранится между запусками
+	if opts.AlertAbove > 0 || opts.AlertBelow > 0 {
+		state := loadAlertState()
+		for _, toCurrency := range toCurrencies {
+			rate, ok := rates.Rates[toCurrency]
+			if !ok {
+				continue
+			}
+			for _, msg := range checkAlerts(state, fromCurrency, toCurrency, rate, opts) {
+				color.New(color.FgYellow).Fprintf(os.Stderr, "🔔 %s\n", msg)
+			}
+		}
+		saveAlertState(state)
+	}
+}
+
+// printHelp выводит справку по использованию программы
+func printHelp() {
+	color.Set(color.FgGreen, color.Bold)
+	fmt.Println("╔════════════════════════════════════════╗")
+	fmt.Println("║     КОНВЕРТЕР ВАЛЮТ (Go Version)       ║")
+	fmt.Println("╚════════════════════════════════════════╝")
+	color.Unset()
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("Использование:")
+	color.Unset()
+	fmt.Println("  go run main.go [флаги] <from> <to> <amount>")
+	fmt.Println("  go run main.go [флаги] <from> <to1,to2,...> <amount>")
+	fmt.Println("  go run main.go [флаги] <to> <amount>   (исходная валюта — из --from, конфига или локали)")
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("Флаги вывода:")
+	color.Unset()
+	color.Cyan("  --json       Вывод результата в формате JSON")
+	color.Cyan("  --csv        Вывод результата в формате CSV")
+	color.Cyan("  --table      Вывод результата в виде таблицы")
+	color.Cyan("  --invoice    Строка для счёта: Service (USD 100.00) → RUB 9,250.00 at 92.5000 on 2024-01-02")
+	color.Cyan("  --invoice-label TEXT  Подпись строки счёта (по умолчанию Service)")
+	color.Cyan("  --format F   Формат вывода: text, json, csv, table, markdown, invoice, fixed")
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("Прочие флаги:")
+	color.Unset()
+	color.Cyan("  --offline    Использовать сохранённые курсы без запроса к API")
+	color.Cyan("  --no-cache         Не читать кэш, всегда загружать свежие курсы")
+	color.Cyan("  --no-cache-write   Не записывать загруженные курсы в кэш")
+	color.Cyan("  --list [BASE]      Показать все курсы для базовой валюты")
+	color.Cyan("  --all <from> <amount>  Конвертировать во все доступные валюты")
+	color.Cyan("  --history          Показать историю всех конвертаций")
+	color.Cyan("  --history USD/RUB  Показать историю по конкретной паре")
+	color.Cyan("  --check-config [FILE]  Проверить конфиг (по умолчанию config.json) без конвертации")
+	color.Cyan("  --since-last-run   Показать изменение курса с прошлой проверки пары")
+	color.Cyan("  --only-changed     Выводить только пары, чей курс изменился с прошлой проверки")
+	color.Cyan("  --color-delta      Красить изменение курса: зелёный — рост, красный — падение")
+	color.Cyan("  --bell             Звуковой сигнал терминала при изменении курса (--no-bell отключает)")
+	color.Cyan("  --watch-notify     То же, что --only-changed --color-delta --bell")
+	color.Cyan("  --set-base-amount <amount> <currency>  Сохранить базовую сумму для --percent")
+	color.Cyan("  --clear-base-amount  Удалить сохранённую базовую сумму")
+	color.Cyan("  --percent P <to>   Конвертировать P%% от базовой суммы")
+	color.Cyan("  --convert-and-hold R|P%%  Симуляция: сравнить с конвертацией по курсу R или при изменении на P%%")
+	color.Cyan("  --via CUR          Конвертировать через промежуточную валюту")
+	color.Cyan("  --round-intermediate  Округлять промежуточную сумму в --via до 2 знаков")
+	color.Cyan("  --changed-only     В --all/--list только валюты, изменившиеся с прошлого снимка")
+	color.Cyan("  --min-change P     Минимальное изменение в процентах для --changed-only")
+	color.Cyan("  --compare-dates D1 D2 FROM TO  Изменение курса пары между датами по снимкам, с годовым темпом")
+	color.Cyan("  --top-movers [BASE] [--days N]  Валюты с наибольшим изменением курса за N дней")
+	color.Cyan("  --locale L         Локаль чисел: ru-RU, en-US, en-GB, de-DE")
+	color.Cyan("  --precision-rate N Знаков после запятой в строке курса (по умолчанию 4)")
+	color.Cyan("  --display-rate-precision N  То же: округляется только показанный курс, не результат")
+	color.Cyan("  --compact-rate-only <from> <to>  Вывести только курс (для приглашения shell)")
+	color.Cyan("  --portfolio FILE [TO]  Стоимость портфеля (CSV, TSV или JSON) в валюте TO")
+	color.Cyan("  --holdings-format F  Формат файла портфеля: csv, tsv, json")
+	color.Cyan("  --batch FILE       Пакетная конвертация строк amount,from,to из CSV")
+	color.Cyan("  --output-sort S    Порядок строк --batch/--all/нескольких валют: input, value, code")
+	color.Cyan("  --whole JPY,KRW    Показывать результат в этих валютах без копеек (только вывод)")
+	color.Cyan("  --from CUR         Исходная валюта для вызова <to> <amount>")
+	color.Cyan("  --then DATE        Сравнить с конвертацией по курсу на дату (из локальных снимков)")
+	color.Cyan("  --flatten [--to CUR] [--export FILE]  Свести все таблицы кэша к одной базе (CSV в FILE)")
+	color.Cyan("  --info CUR         Справка о валюте: название, символ, знаки, цифровой код, регион и курс")
+	color.Cyan("  --color-rate-by-movement  Красить курс по изменению к прошлому снимку: рост — зелёный, падение — красный")
+	color.Cyan("  --no-preview       Не показывать сводку перед запросом в интерактивном режиме")
+	color.Cyan("  --scan-text CUR    Дописать к ценам в тексте из stdin сумму в валюте CUR")
+	color.Cyan("  --as-fraction      Показать курс ещё и простой дробью: 1 USD ≈ 37/40 EUR")
+	color.Cyan("  --max-denominator N  Наибольший знаменатель дроби для --as-fraction (по умолчанию 1000)")
+	color.Cyan("  --explain-rounding Пошагово показать округление результата, курса и итогов")
+	color.Cyan("  --alert-above R    Оповестить в stderr, когда курс поднимется выше R")
+	color.Cyan("  --alert-below R    Оповестить в stderr, когда курс опустится ниже R")
+	color.Cyan("  --alert-repeat     Оповещать при каждом запуске, пока курс за порогом")
+	color.Cyan("  --smooth N         Конвертировать по медиане курса за последние N дней снимков")
+	color.Cyan("  --smooth-method M  Способ сглаживания для --smooth: median (по умолчанию) или mean")
+	color.Cyan("  --align            Выравнивать числа в строках результатов по самой широкой")
+	color.Cyan("  --self-test        Проверить ядро конвертации на встроенных данных (без сети)")
+	color.Cyan("  --receipt          Квитанция с UUID; с --json добавляет поле receipt_id")
+	color.Cyan("  --implied-rate FROM TO SRC DST  Курс по двум суммам и сравнение с рыночным")
+	color.Cyan("  --progress         Индикатор выполнения для --batch и --portfolio (только в терминале)")
+	color.Cyan("  --yes, -y          Не спрашивать подтверждение для большого --batch/--portfolio")
+	color.Cyan("  --large-batch-threshold N  С какого числа строк спрашивать подтверждение (по умолчанию 1000)")
+	color.Cyan("  --stream FROM TO   Суммы по одной на строку из stdin, результаты — по одной на строку")
+	color.Cyan("  --trim-zeros       Убирать нули в конце дробной части (9250.5000 → 9250.5) в тексте и таблицах")
+	color.Cyan("  --rates-stdin      Взять курсы из JSON в stdin (формат ответа API) вместо запроса к провайдеру")
+	color.Cyan("  --fail-fast        Остановить --batch на первой строке с ошибкой")
+	color.Cyan("  --timeout-budget D Предел времени на весь --batch: новые строки после него не начинаются")
+	color.Cyan("  --dedupe           Схлопнуть одинаковые строки пакета и показать число повторов")
+	color.Cyan("  --verify           Не использовать курсы, отличающиеся от снимка больше чем в 10 раз")
+	color.Cyan("  --verify-warn      То же, но только предупреждать")
+	color.Cyan("  --verify-factor X  Допустимое отклонение для --verify (по умолчанию 10)")
+	color.Cyan("  --pair-notation    Добавить котировку в виде USDRUB=92.5000")
+	color.Cyan("  --cache-ls         Показать сохранённые курсы с возрастом и размером")
+	color.Cyan("  --cache-prune --older-than D  Удалить записи кэша старше D (72h, 7d)")
+	color.Cyan("  --target-result X <from> <to>  Сколько нужно <from>, чтобы получить X <to>")
+	color.Cyan("  --max-response-size S  Предел размера ответа API (по умолчанию 4MB)")
+	color.Cyan("  --retries N        Повторить запрос к API до N раз при сбое сети или ответе 5xx/429")
+	color.Cyan("  --retry-idempotent-only  Повторять только идемпотентные запросы (по умолчанию так и есть)")
+	color.Cyan("  --timeout D        Общий предел на запрос к API (по умолчанию 10s)")
+	color.Cyan("  --connect-timeout D  Таймаут установки соединения с API")
+	color.Cyan("  --read-timeout D   Таймаут ожидания ответа API после подключения")
+	color.Cyan("  --net-profile NAME Прокси, корневой сертификат и таймаут из net_profiles конфига")
+	color.Cyan("  --prefer-fresh-within D  Кэш моложе D без запроса; иначе загрузка с откатом на кэш при ошибке")
+	color.Cyan("  --audit-log FILE   Дописывать в FILE журнал аудита (JSON Lines): провайдер, URL, sha256 ответа, результат")
+	color.Cyan("  --magnitude-warn   Предупреждать, если результат больше порога (по умолчанию 1e9)")
+	color.Cyan("  --magnitude-threshold X  Порог для --magnitude-warn (в конфиге — magnitude_threshold)")
+	color.Cyan("  --compare-to-mid   Показать bid/ask, mid и спред (если провайдер их отдаёт)")
+	color.Cyan("  --json-rates-path P  Путь к курсам в ответе нестандартного провайдера ($.data.rates)")
+	color.Cyan("  --json-base-path P   Путь к базовой валюте; --json-date-path P — к дате")
+	color.Cyan("  --no-color         Отключить цветной вывод (также учитывается NO_COLOR)")
+	color.Cyan("  --no-prompt        Не запрашивать ввод: ошибка (код 2), если не хватает аргументов")
+	color.Cyan("  --percent-precision N  Знаков после запятой в процентах изменений (по умолчанию 2)")
+	color.Cyan("  --max-targets N    Показать не более N целевых валют")
+	color.Cyan("  --precision-inverse N  Знаков после запятой в обратном курсе (по умолчанию 6)")
+	color.Cyan("  --strict           Завершаться с ошибкой при любых предупреждениях")
+	color.Cyan("  --verbose, -v      Подробный диагностический вывод (в stderr)")
+	color.Cyan("  --help, -h   Показать эту справку")
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("Примеры:")
+	color.Unset()
+	fmt.Println("  go run main.go USD RUB 100")
+	fmt.Println("  go run main.go --table USD RUB,EUR,CNY 100")
+	fmt.Println("  go run main.go --json USD EUR 50")
+	fmt.Println("  go run main.go --offline USD RUB 100")
+	fmt.Println("  go run main.go --list EUR")
+	fmt.Println("  go run main.go --percent 25 EUR")
+	fmt.Println("  go run main.go --table --all USD 100")
+	fmt.Println("  go run main.go --history USD/RUB")
+	fmt.Println()
+}
+
+// printHeader выводит заголовок программы
+func printHeader() {
+	color.Set(color.FgGreen, color.Bold)
+	fmt.Println("╔════════════════════════════════════════╗")
+	fmt.Println("║     КОНВЕРТЕР ВАЛЮТ (Go Version)       ║")
+	fmt.Println("╚════════════════════════════════════════╝")
+	color.Unset()
+	fmt.Println()
+}
+
+// stdinIsTerminal сообщает, подключён ли stdin к терминалу
+func stdinIsTerminal() bool {
+	fd := os.Stdin.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// stdoutIsTerminal сообщает, подключён ли stdout к терминалу (для звукового сигнала)
+func stdoutIsTerminal() bool {
+	fd := os.Stdout.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// stderrIsTerminal сообщает, подключён ли stderr к терминалу (для индикатора выполнения)
+func stderrIsTerminal() bool {
+	fd := os.Stderr.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// canPrompt решает, можно ли запрашивать недостающие параметры интерактивно
+func canPrompt(noPrompt, stdinTTY bool) bool {
+	return !noPrompt && stdinTTY
+}
+
+// promptText возвращает подсказку из конфига или встроенную, подставляя
+// значение по умолчанию вместо {default}
+func promptText(template, fallback, def string) string {
+	if template == "" {
+		template = fallback
+	}
+	return strings.ReplaceAll(template, "{default}", def)
+}
+
+// getInput получает ввод от пользователя
+func getInput(prompt string) string {
+	fmt.Print(prompt)
+	var input string
+	fmt.Scanln(&input)
+	return strings.ToUpper(strings.TrimSpace(input))
+}
+
+// askConfirmation задаёт вопрос в stderr (stdout может быть занят JSON/CSV) и
+// возвращает true на ответ y/yes/д/да
+func askConfirmation(prompt string) bool {
+	fmt.Fprint(os.Stderr, prompt)
+	var input string
+	fmt.Scanln(&input)
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "y", "yes", "д", "да":
+		return true
+	}
+	return false
+}
+
+// batchSources оценивает число запросов к API для пакета: по одному на исходную валюту
+func batchSources(rows []BatchRow) int {
+	sources := make(map[string]bool)
+	for _, row := range rows {
+		sources[strings.ToUpper(strings.TrimSpace(row.From))] = true
+	}
+	return len(sources)
+}
+
+// confirmLargeBatch спрашивает подтверждение, если строк больше порога; без
+// терминала вместо вопроса требуется --yes
+func confirmLargeBatch(rows, calls int, opts Options, interactive bool, ask func(string) bool) error {
+	if rows <= opts.LargeBatchThreshold || opts.Yes {
+		return nil
+	}
+	summary := fmt.Sprintf("строк: %d (порог %d), запросов к API: до %d", rows, opts.LargeBatchThreshold, calls)
+	if !interactive {
+		return fmt.Errorf("большой пакет — %s; запустите с --yes, чтобы продолжить", summary)
+	}
+	if !ask(fmt.Sprintf("⚠️  Большой пакет — %s. Продолжить? [y/N]: ", summary)) {
+		return errors.New("отменено пользователем")
+	}
+	return nil
+}
+
+// getAmount получает сумму от пользователя
+func getAmount(prompt string) float64 {
+	fmt.Print(prompt)
+	var input string
+	fmt.Scanln(&input)
+	amount, err := strconv.ParseFloat(input, 64)
+	if err != nil {
+		color.Red("❌ Ошибка: неверная сумма")
+		os.Exit(1)
+	}
+	return amount
+}
+
+// getAmountOr получает сумму от пользователя; пустой ввод — значение def
+func getAmountOr(prompt string, def float64) float64 {
+	fmt.Print(prompt)
+	var input string
+	fmt.Scanln(&input)
+	if strings.TrimSpace(input) == "" {
+		return def
+	}
+	amount, err := strconv.ParseFloat(input, 64)
+	if err != nil {
+		color.Red("❌ Ошибка: неверная сумма")
+		os.Exit(1)
+	}
+	return amount
+}
+
+// previewText сводка интерактивного ввода перед обращением к провайдеру
+func previewText(from, to string, amount float64, opts Options) string {
+	source := "провайдер " + providerName
+	if opts.Offline {
+		source = "сохранённые курсы (оффлайн)"
+	}
+	return fmt.Sprintf("🔎 Будет выполнено: %s %s → %s, %s", formatNumber(amount, 2, opts.Locale), from,
+		strings.ReplaceAll(to, ",", ", "), source)
+}
+
+// previewAccepted проверяет ответ на сводку: Enter, y/yes или д/да — продолжить
+func previewAccepted(answer string) bool {
+	switch strings.ToUpper(strings.TrimSpace(answer)) {
+	case "", "Y", "YES", "Д", "ДА":
+		return true
+	}
+	return false
+}
+
+// loadCache загружает кэш курсов из файла
+func loadCache() map[string]CacheEntry {
+	cache := make(map[string]CacheEntry)
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return cache
+	}
+	json.Unmarshal(data, &cache)
+	return cache
+}
+
+// saveCache сохраняет кэш курсов в файл
+func saveCache(cache map[string]CacheEntry) {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+	os.WriteFile(cacheFile, data, 0644)
+}
+
+// parseDuration разбирает длительность в формате time.ParseDuration,
+// дополнительно поддерживая дни: 7d, 1d12h
+func parseDuration(value string) (time.Duration, error) {
+	days := 0
+	if i := strings.Index(value, "d"); i > 0 {
+		n, err := strconv.Atoi(value[:i])
+		if err != nil {
+			return 0, fmt.Errorf("неверная длительность %q", value)
+		}
+		days, value = n, value[i+1:]
+	}
+	d := time.Duration(0)
+	if value != "" {
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("неверная длительность %q", value)
+		}
+	}
+	return time.Duration(days)*24*time.Hour + d, nil
+}
+
+// cacheEntrySize возвращает размер записи кэша в байтах (в JSON)
+func cacheEntrySize(entry CacheEntry) int {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// printCacheList выводит записи кэша с возрастом и размером
+func printCacheList(cache map[string]CacheEntry, now time.Time) {
+	if len(cache) == 0 {
+		color.Yellow("📝 Кэш курсов пуст")
+		return
+	}
+	bases := make([]string, 0, len(cache))
+	for base := range cache {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Printf("  Кэш курсов (%s)\n", cacheFile)
+	fmt.Println("  ┌──────────┬──────────────────┬──────────────────────┬────────────┐")
+	fmt.Println("  │ Базис    │ Сохранено        │ Возраст              │ Размер     │")
+	fmt.Println("  ├──────────┼──────────────────┼──────────────────────┼────────────┤")
+	color.Unset()
+	total := 0
+	for _, base := range bases {
+		entry := cache[base]
+		size := cacheEntrySize(entry)
+		total += size
+		line := fmt.Sprintf("  │ %-8s │ %-16s │ %-20s │ %-10s │", base,
+			entry.FetchedAt.Format("2006-01-02 15:04"), formatTimeAgo(now.Sub(entry.FetchedAt)),
+			fmt.Sprintf("%.1f КБ", float64(size)/1024))
+		if now.Sub(entry.FetchedAt) < cacheTTL {
+			color.Green("%s", line)
+		} else {
+			fmt.Println(line)
+		}
+	}
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("  └──────────┴──────────────────┴──────────────────────┴────────────┘")
+	color.Unset()
+	color.HiBlack("  Записей: %d, всего %.1f КБ", len(cache), float64(total)/1024)
+	fmt.Println()
+}
+
+// pruneCache удаляет из кэша записи старше olderThan и возвращает их базисы
+func pruneCache(cache map[string]CacheEntry, olderThan time.Duration, now time.Time) []string {
+	var removed []string
+	for base, entry := range cache {
+		if now.Sub(entry.FetchedAt) > olderThan {
+			delete(cache, base)
+			removed = append(removed, base)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// getExchangeRates получает курсы валют из кэша или API; targets — нужные целевые
+// валюты, по ним в оффлайн режиме выбирается таблица кэша для пересчёта через базис
+func getExchangeRates(baseCurrency string, silent bool, offline bool, targets ...string) (*ExchangeRateResponse, error) {
+	if stdinRates != nil {
+		return ratesInBase(stdinRates, baseCurrency)
+	}
+	cache := loadCache()
+	if noCache && !offline {
+		rates, err := fetchRates(baseCurrency)
+		if err != nil {
+			return nil, err
+		}
+		logVerbose("ℹ️  Курсы %s: %s, загружены из API без чтения кэша (--no-cache)", baseCurrency, rates.Provider)
+		storeRates(cache, baseCurrency, rates)
+		return rates, nil
+	}
+	if preferFreshWithin > 0 && !offline {
+		return fetchPreferFresh(cache, baseCurrency, silent)
+	}
+	if entry, ok := cache[baseCurrency]; ok {
+		if offline || time.Since(entry.FetchedAt) < cacheTTL {
+			if !silent {
+				if offline {
+					color.HiBlack("📴 Оффлайн режим: используются сохранённые курсы от %s",
+						entry.FetchedAt.Format("2006-01-02 15:04"))
+				} else {
+					color.HiBlack("💾 Используются кэшированные курсы (обновление через %d мин.)",
+						int(cacheTTL.Minutes())-int(time.Since(entry.FetchedAt).Minutes()))
+				}
+			}
+			if offline && time.Since(entry.FetchedAt) >= cacheTTL {
+				addWarning("устаревшие курсы %s: сохранены %s", baseCurrency, entry.FetchedAt.Format("2006-01-02 15:04"))
+			}
+			data := cachedRates(entry)
+			logVerbose("ℹ️  Курсы %s: %s, из кэша (сохранены %s)", baseCurrency, data.Provider, entry.FetchedAt.Format("2006-01-02 15:04"))
+			return data, nil
+		}
+	}
+
+	if offline {
+		// Точного кэша нет — пересчитываем курсы через другой сохранённый базис
+		if rebased, source, ok := rebaseFromCache(cache, baseCurrency, targets...); ok {
+			if !silent {
+				color.HiBlack("📴 Оффлайн режим: курсы %s пересчитаны через сохранённые курсы %s от %s",
+					baseCurrency, source.Data.Base, source.FetchedAt.Format("2006-01-02 15:04"))
+			}
+			if time.Since(source.FetchedAt) >= cacheTTL {
+				addWarning("устаревшие курсы %s: сохранены %s", source.Data.Base, source.FetchedAt.Format("2006-01-02 15:04"))
+			}
+			rebased.Cached = true
+			rebased.Provider = source.Data.Provider
+			rebased.RequestURL = source.Data.RequestURL
+			rebased.ResponseHash = source.Data.ResponseHash
+			if rebased.Provider == "" {
+				rebased.Provider = providerName
+			}
+			logVerbose("ℹ️  Курсы %s: %s, из кэша через базис %s", baseCurrency, rebased.Provider, source.Data.Base)
+			return rebased, nil
+		}
+		return nil, fmt.Errorf("нет сохранённых курсов для %s — выполните конвертацию онлайн хотя бы раз", baseCurrency)
+	}
+
+	rates, err := fetchRates(baseCurrency)
+	if err != nil {
+		return nil, err
+	}
+	logVerbose("ℹ️  Курсы %s: %s, загружены из API", baseCurrency, rates.Provider)
+	storeRates(cache, baseCurrency, rates)
+	return rates, nil
+}
+
+// fetchPreferFresh политика --prefer-fresh-within: кэш моложе окна используется
+// сразу, иначе курсы загружаются, а при ошибке API берётся кэш любой давности
+func fetchPreferFresh(cache map[string]CacheEntry, baseCurrency string, silent bool) (*ExchangeRateResponse, error) {
+	entry, hasEntry := cache[baseCurrency]
+	if hasEntry && time.Since(entry.FetchedAt) < preferFreshWithin {
+		logVerbose("ℹ️  Курсы %s: кэш моложе %s, запрос не нужен", baseCurrency, preferFreshWithin)
+		return cachedRates(entry), nil
+	}
+
+	rates, err := fetchRates(baseCurrency)
+	if err == nil {
+		logVerbose("ℹ️  Курсы %s: кэш старше %s или отсутствует, загружены из API", baseCurrency, preferFreshWithin)
+		storeRates(cache, baseCurrency, rates)
+		return rates, nil
+	}
+	if !hasEntry {
+		return nil, err
+	}
+
+	logVerbose("ℹ️  Курсы %s: API недоступен (%v), используется кэш от %s", baseCurrency, err, entry.FetchedAt.Format("2006-01-02 15:04"))
+	if !silent {
+		color.HiBlack("💾 API недоступен, используются кэшированные курсы от %s", entry.FetchedAt.Format("2006-01-02 15:04"))
+	}
+	addWarning("курсы %s не обновлены: %v", baseCurrency, err)
+	return cachedRates(entry), nil
+}
+
+// cachedRates возвращает копию курсов из записи кэша с пометкой источника
+func cachedRates(entry CacheEntry) *ExchangeRateResponse {
+	data := entry.Data
+	data.Cached = true
+	if data.Provider == "" {
+		data.Provider = providerName
+	}
+	return &data
+}
+
+// storeRates сохраняет загруженные курсы в кэш (кроме --no-cache-write) и в снимки курсов
+func storeRates(cache map[string]CacheEntry, baseCurrency string, rates *ExchangeRateResponse) {
+	if storeCheck != nil && !storeCheck(baseCurrency, rates) {
+		logVerbose("ℹ️  Курсы %s не сохранены: --verify нашёл подозрительные курсы", baseCurrency)
+		return
+	}
+	fetchedAt := time.Now()
+	if !noCacheWrite {
+		cache[baseCurrency] = CacheEntry{FetchedAt: fetchedAt, Data: *rates}
+		saveCache(cache)
+	}
+	snapshots := loadSnapshots()
+	recordSnapshot(snapshots, baseCurrency, rates, fetchedAt)
+	saveSnapshots(snapshots)
+}
+
+// RetryPolicy сколько раз повторять запрос и можно ли повторять неидемпотентные
+type RetryPolicy struct {
+	Attempts       int  // число повторов после первой попытки
+	IdempotentOnly bool // повторять только идемпотентные методы (GET, HEAD, PUT, DELETE...)
+}
+
+// isIdempotent сообщает, безопасно ли повторять запрос с этим методом (RFC 9110, 9.2.2)
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryable сообщает, стоит ли повторить запрос после такого ответа или ошибки
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// doWithRetry выполняет запрос с повторами по политике. Запросы к провайдерам
+// сейчас только GET и повторяются безопасно; неидемпотентный запрос при
+// IdempotentOnly выполняется ровно один раз, а запрос с телом без GetBody не
+// повторяется никогда, чтобы не отправить пустое тело
+func doWithRetry(client *http.Client, req *http.Request, policy RetryPolicy) (*http.Response, error) {
+	attempts := policy.Attempts
+	if policy.IdempotentOnly && !isIdempotent(req.Method) {
+		attempts = 0
+	}
+	if req.Body != nil && req.GetBody == nil {
+		attempts = 0
+	}
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= attempts || !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		logVerbose("ℹ️  Повтор запроса %s %s (%d из %d) через %s", req.Method, redactURL(req.URL.String()), attempt+1, attempts, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// fetchRates загружает курсы из API без обращения к кэшу
+func fetchRates(baseCurrency string) (*ExchangeRateResponse, error) {
+	requestURL := apiURL + baseCurrency
+	req, err := http.NewRequestWithContext(requestContext, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при запросе к API: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req, retryPolicy)
+	if err != nil {
+		if kind := timeoutKind(err); kind != "" {
+			return nil, fmt.Errorf("ошибка при запросе к API (%s): %w", kind, err)
+		}
+		return nil, fmt.Errorf("ошибка при запросе к API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API вернул код ошибки: %d", resp.StatusCode)
+	}
+
+	body, err := readLimited(resp.Body, maxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var rates *ExchangeRateResponse
+	if responsePaths != (ResponsePaths{}) {
+		rates, err = parseRatesWithPaths(body, baseCurrency, responsePaths)
+	} else {
+		rates, err = parseRatesResponse(body, baseCurrency)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rates.Provider = providerName
+	rates.RequestURL = redactURL(requestURL)
+	rates.ResponseHash = hashResponse(body)
+	return rates, nil
+}
+
+// readLimited читает тело ответа не больше limit байт; более длинный ответ — ошибка
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("ответ API больше %s — увеличьте --max-response-size, если это ожидаемо", formatSize(limit))
+	}
+	return body, nil
+}
+
+// parseSize разбирает размер в байтах: 1048576, 512KB, 8MB (KB и MB — по 1024)
+func parseSize(value string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(v, "MB"):
+		multiplier, v = 1<<20, strings.TrimSuffix(v, "MB")
+	case strings.HasSuffix(v, "KB"):
+		multiplier, v = 1<<10, strings.TrimSuffix(v, "KB")
+	case strings.HasSuffix(v, "B"):
+		v = strings.TrimSuffix(v, "B")
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("неверный размер %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize форматирует размер в байтах для сообщений: 4 МБ, 512 КБ, 100 байт
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20 && size%(1<<20) == 0:
+		return fmt.Sprintf("%d МБ", size>>20)
+	case size >= 1<<10 && size%(1<<10) == 0:
+		return fmt.Sprintf("%d КБ", size>>10)
+	}
+	return fmt.Sprintf("%d байт", size)
+}
+
+// providerErrorBody известные формы ошибки, которые провайдеры возвращают
+// с кодом 200 вместо объекта с курсами (например, {"error":"maintenance"})
+type providerErrorBody struct {
+	Error     string `json:"error"`
+	ErrorType string `json:"error-type"`
+	Message   string `json:"message"`
+}
+
+// providerErrorMessage извлекает сообщение об ошибке провайдера из тела ответа
+func providerErrorMessage(body []byte) string {
+	var pe providerErrorBody
+	if json.Unmarshal(body, &pe) != nil {
+		return ""
+	}
+	for _, msg := range []string{pe.Error, pe.ErrorType, pe.Message} {
+		if msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+// parseRatesResponse разбирает ответ API и проверяет базовую валюту
+func parseRatesResponse(body []byte, requestedBase string) (*ExchangeRateResponse, error) {
+	// Курсы разбираются отдельно: часть провайдеров отдаёт числа строками ("92.5")
+	var wire struct {
+		ExchangeRateResponse
+		Rates map[string]json.RawMessage `json:"rates"`
+		Bid   map[string]json.RawMessage `json:"bid"`
+		Ask   map[string]json.RawMessage `json:"ask"`
+	}
+	if err := json.Unmarshal(body, &wire); err != nil {
+		if msg := providerErrorMessage(body); msg != "" {
+			return nil, fmt.Errorf("провайдер вернул ошибку: %s", msg)
+		}
+		return nil, fmt.Errorf("ошибка парсинга JSON: %w", err)
+	}
+	rates := wire.ExchangeRateResponse
+	var err error
+	if rates.Rates, err = parseRateValues(wire.Rates, "rates"); err != nil {
+		return nil, err
+	}
+	if rates.Bid, err = parseRateValues(wire.Bid, "bid"); err != nil {
+		return nil, err
+	}
+	if rates.Ask, err = parseRateValues(wire.Ask, "ask"); err != nil {
+		return nil, err
+	}
+	if len(rates.Rates) == 0 {
+		if msg := providerErrorMessage(body); msg != "" {
+			return nil, fmt.Errorf("провайдер вернул ошибку: %s", msg)
+		}
+		return nil, fmt.Errorf("ответ API не содержит курсов")
+	}
+	if err := normalizeBase(&rates, requestedBase); err != nil {
+		return nil, err
+	}
+	return &rates, nil
+}
+
+// resolveCurrencyInput переводит ввод пользователя в код валюты: код возвращается
+// как есть, символ — через справочник и symbol_precedence; для неоднозначного
+// символа без предпочтения возвращаются кандидаты и ошибка
+func resolveCurrencyInput(input string, precedence map[string]string) (string, []string, error) {
+	symbol := strings.ToUpper(strings.TrimSpace(input))
+	candidates, ok := currencySymbols[symbol]
+	if !ok {
+		return symbol, nil, nil
+	}
+	for s, code := range precedence {
+		if strings.ToUpper(strings.TrimSpace(s)) == symbol {
+			return strings.ToUpper(code), nil, nil
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil, nil
+	}
+	return "", candidates, fmt.Errorf("символ %s неоднозначен: %s — укажите код или задайте symbol_precedence в конфиге",
+		input, strings.Join(candidates, ", "))
+}
+
+// resolveCurrencyList применяет resolveCurrencyInput к списку валют через запятую
+func resolveCurrencyList(input string, precedence map[string]string) (string, []string, error) {
+	parts := strings.Split(input, ",")
+	for i, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		code, candidates, err := resolveCurrencyInput(part, precedence)
+		if err != nil {
+			return "", candidates, err
+		}
+		parts[i] = code
+	}
+	return strings.Join(parts, ","), nil, nil
+}
+
+// askCurrency запрашивает валюту (или список через запятую) и при неоднозначном
+// символе показывает кандидатов и спрашивает снова
+func askCurrency(prompt, def string, precedence map[string]string) string {
+	for {
+		input := getInput(prompt)
+		if input == "" {
+			return def
+		}
+		codes, candidates, err := resolveCurrencyList(input, precedence)
+		if err == nil {
+			return codes
+		}
+		color.Yellow("⚠️  Символ означает несколько валют: %s", strings.Join(candidates, ", "))
+		prompt = "Уточните код валюты: "
+	}
+}
+
+// PriceMatch цена, найденная в тексте для --scan-text
+type PriceMatch struct {
+	End      int // позиция сразу после цены в строке
+	Amount   float64
+	Currency string // код или символ, как в тексте
+}
+
+// scanPrices находит цены в строке; запятая в сумме считается десятичным разделителем
+func scanPrices(line string) []PriceMatch {
+	var matches []PriceMatch
+	for _, m := range priceRegexp.FindAllStringSubmatchIndex(line, -1) {
+		var currency, number string
+		if m[2] >= 0 {
+			currency, number = line[m[2]:m[3]], line[m[4]:m[5]]
+		} else {
+			number, currency = line[m[6]:m[7]], line[m[8]:m[9]]
+		}
+		// Совпадение не должно обрываться внутри числа: «$1,299.00» не режется на «$1,299»
+		if continuesNumber(line[m[1]:]) {
+			continue
+		}
+		amount, err := parsePriceNumber(number)
+		if err != nil {
+			continue
+		}
+		matches = append(matches, PriceMatch{End: m[1], Amount: amount, Currency: currency})
+	}
+	return matches
+}
+
+// continuesNumber сообщает, что текст продолжает число: цифра или разделитель с цифрой
+func continuesNumber(rest string) bool {
+	if rest == "" {
+		return false
+	}
+	if rest[0] >= '0' && rest[0] <= '9' {
+		return true
+	}
+	return len(rest) > 1 && (rest[0] == '.' || rest[0] == ',') && rest[1] >= '0' && rest[1] <= '9'
+}
+
+// parsePriceNumber разбирает сумму из текста с учётом разделителей тысяч: если есть
+// и точка, и запятая, десятичным считается последний разделитель (1,299.00 и 1.234,56);
+// единственный разделитель перед тремя цифрами — разделитель тысяч (2,500),
+// иначе десятичный (4,50); пробелы внутри числа — разделители тысяч (1 200)
+func parsePriceNumber(number string) (float64, error) {
+	s := strings.NewReplacer(" ", "", "\u00a0", "").Replace(number)
+	dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+	switch {
+	case dot >= 0 && comma >= 0:
+		decimal, thousands := ".", ","
+		if comma > dot {
+			decimal, thousands = ",", "."
+		}
+		s = strings.ReplaceAll(s, thousands, "")
+		s = strings.Replace(s, decimal, ".", 1)
+	case dot >= 0 || comma >= 0:
+		sep := "."
+		if comma >= 0 {
+			sep = ","
+		}
+		parts := strings.Split(s, sep)
+		grouped := parts[0] != "0"
+		for _, p := range parts[1:] {
+			grouped = grouped && len(p) == 3
+		}
+		if grouped {
+			s = strings.Join(parts, "")
+		} else if len(parts) == 2 {
+			s = parts[0] + "." + parts[1]
+		} else {
+			return 0, fmt.Errorf("неверная сумма %q", number)
+		}
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// scanText дополняет каждую найденную цену суммой в целевой валюте: «$4.50 (4.14 EUR)».
+// Курсы берутся из таблицы целевой валюты; строки без цен, цены в неизвестной
+// валюте, в целевой валюте и с неоднозначным символом остаются без изменений
+func scanText(text, target string, rates *ExchangeRateResponse, precedence map[string]string, opts Options) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		matches := scanPrices(line)
+		for j := len(matches) - 1; j >= 0; j-- {
+			m := matches[j]
+			code, _, err := resolveCurrencyInput(m.Currency, precedence)
+			if err != nil {
+				addWarning("строка %d: %v", i+1, err)
+				continue
+			}
+			rate, ok := rates.Rates[code]
+			if !ok || rate == 0 || code == target {
+				continue
+			}
+			converted := fmt.Sprintf(" (%s %s)", formatNumber(m.Amount/rate, resultDecimals(target, opts.Whole), opts.Locale), target)
+			line = line[:m.End] + converted + line[m.End:]
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "")
+}
+
+// CurrencyDetails всё, что известно о валюте, для --info
+type CurrencyDetails struct {
+	CurrencyInfo
+	Symbols []string `json:"symbols,omitempty"`
+	Known   bool     `json:"known"` // есть во встроенном справочнике
+	Base    string   `json:"base,omitempty"`
+	Rate    float64  `json:"rate,omitempty"` // 1 Base = Rate валюты
+	Date    string   `json:"date,omitempty"`
+	Cached  bool     `json:"cached,omitempty"`
+}
+
+// currencySymbolsFor символы, которыми обозначается валюта; однозначные идут первыми
+func currencySymbolsFor(code string) []string {
+	var unique, shared []string
+	for symbol, codes := range currencySymbols {
+		if !containsString(codes, code) {
+			continue
+		}
+		if len(codes) == 1 {
+			unique = append(unique, symbol)
+		} else {
+			shared = append(shared, symbol)
+		}
+	}
+	sort.Strings(unique)
+	sort.Strings(shared)
+	return append(unique, shared...)
+}
+
+// editDistance расстояние Левенштейна между двумя короткими строками
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// suggestCurrencies подбирает известные коды, отличающиеся от введённого одной буквой
+func suggestCurrencies(code string, rates *ExchangeRateResponse) []string {
+	seen := make(map[string]bool)
+	for _, c := range currencyTable {
+		seen[c.Code] = true
+	}
+	if rates != nil {
+		for c := range rates.Rates {
+			seen[c] = true
+		}
+	}
+	var suggestions []string
+	for c := range seen {
+		if editDistance(code, c) == 1 {
+			suggestions = append(suggestions, c)
+		}
+	}
+	sort.Strings(suggestions)
+	if len(suggestions) > 5 {
+		suggestions = suggestions[:5]
+	}
+	return suggestions
+}
+
+// currencyDetails собирает справочные данные валюты и её курс к base; валюта
+// неизвестна, если её нет ни в справочнике, ни в таблице курсов
+func currencyDetails(code, base string, rates *ExchangeRateResponse) (CurrencyDetails, error) {
+	info, err := lookupCurrency(code)
+	if err != nil {
+		return CurrencyDetails{}, err
+	}
+	code = info.Code
+	details := CurrencyDetails{CurrencyInfo: info, Symbols: currencySymbolsFor(code)}
+	for _, c := range currencyTable {
+		if c.Code == code {
+			details.Known = true
+		}
+	}
+	rate, hasRate := 0.0, false
+	if rates != nil {
+		rate, hasRate = rates.Rates[code]
+	}
+	if !details.Known && !hasRate {
+		msg := fmt.Sprintf("неизвестная валюта %s", code)
+		if suggestions := suggestCurrencies(code, rates); len(suggestions) > 0 {
+			msg += " — возможно, " + strings.Join(suggestions, ", ")
+		}
+		return CurrencyDetails{}, errors.New(msg)
+	}
+	if hasRate {
+		details.Base, details.Rate, details.Date, details.Cached = base, rate, rateDate(rates), rates.Cached
+	}
+	return details, nil
+}
+
+// printCurrencyDetails выводит карточку валюты для --info
+func printCurrencyDetails(d CurrencyDetails, opts Options) {
+	field := func(label, value string) { color.Cyan("  %s %s", padRight(label+":", 21), value) }
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Printf("  %s — %s\n", d.Code, d.Name)
+	color.Unset()
+	if !d.Known {
+		color.HiBlack("  нет во встроенном справочнике, знаков после запятой — по умолчанию")
+	}
+	if len(d.Symbols) > 0 {
+		field("Символ", strings.Join(d.Symbols, ", "))
+	}
+	field("Знаков после запятой", strconv.Itoa(d.MinorUnits))
+	if d.Numeric != "" {
+		field("Цифровой код", d.Numeric)
+	}
+	if d.Region != "" {
+		field("Регион", d.Region)
+	}
+	if d.Base == "" {
+		color.HiBlack("  Курс недоступен")
+		fmt.Println()
+		return
+	}
+	source := ""
+	if d.Cached {
+		source = ", кэш"
+	}
+	field("Курс", fmt.Sprintf("1 %s = %s %s (%s%s)", d.Base, formatNumber(d.Rate, opts.PrecisionRate, opts.Locale), d.Code, d.Date, source))
+	if d.Rate != 0 {
+		field("Обратный курс", fmt.Sprintf("1 %s = %s %s", d.Code, formatInverseRate(1/d.Rate, opts.PrecisionInverse, opts.Locale), d.Base))
+	}
+	fmt.Println()
+}
+
+// lookupCurrency нормализует и проверяет код валюты и возвращает его справочные данные
+func lookupCurrency(code string) (CurrencyInfo, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if !isCurrencyCode(code) {
+		return CurrencyInfo{}, fmt.Errorf("неверный код валюты %q", code)
+	}
+	info := CurrencyInfo{Code: code, Name: code, MinorUnits: 2}
+	for _, c := range currencyTable {
+		if c.Code == code {
+			info = c
+			break
+		}
+	}
+	if units, ok := minorUnitsOverrides[code]; ok {
+		info.MinorUnits = units
+	}
+	return info, nil
+}
+
+// normalizeMinorUnits приводит коды валют из minor_units к верхнему регистру
+func normalizeMinorUnits(units map[string]int) map[string]int {
+	if len(units) == 0 {
+		return nil
+	}
+	out := make(map[string]int, len(units))
+	for code, n := range units {
+		out[strings.ToUpper(strings.TrimSpace(code))] = n
+	}
+	return out
+}
+
+// currencyMetaCache запоминает результаты lookupCurrency на время пакетного прогона,
+// чтобы повторяющиеся коды не проверялись и не искались в справочнике заново
+type currencyMetaCache struct {
+	info map[string]CurrencyInfo
+	errs map[string]error
+}
+
+// newCurrencyMetaCache создаёт пустой кэш справочных данных
+func newCurrencyMetaCache() *currencyMetaCache {
+	return &currencyMetaCache{info: make(map[string]CurrencyInfo), errs: make(map[string]error)}
+}
+
+// lookup возвращает справочные данные из кэша; nil-кэш ищет напрямую
+func (m *currencyMetaCache) lookup(code string) (CurrencyInfo, error) {
+	if m == nil {
+		return lookupCurrency(code)
+	}
+	if info, ok := m.info[code]; ok {
+		return info, nil
+	}
+	if err, ok := m.errs[code]; ok {
+		return CurrencyInfo{}, err
+	}
+	info, err := lookupCurrency(code)
+	if err != nil {
+		m.errs[code] = err
+	} else {
+		m.info[code] = info
+	}
+	return info, err
+}
+
+// parseJSONPath разбирает путь вида $.data.rates или result.items[0].rates
+// на ключи объектов (string) и индексы массивов (int)
+func parseJSONPath(path string) ([]any, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return nil, fmt.Errorf("пустой путь")
+	}
+	var steps []any
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key == "" && rest == "" {
+			return nil, fmt.Errorf("пустой сегмент в %q", path)
+		}
+		if key != "" {
+			steps = append(steps, key)
+		}
+		for rest != "" {
+			idx, tail, ok := strings.Cut(rest, "]")
+			n, err := strconv.Atoi(idx)
+			if !ok || err != nil || n < 0 {
+				return nil, fmt.Errorf("неверный индекс в %q", part)
+			}
+			steps = append(steps, n)
+			if tail == "" {
+				break
+			}
+			if !strings.HasPrefix(tail, "[") {
+				return nil, fmt.Errorf("неверный сегмент %q", part)
+			}
+			rest = tail[1:]
+		}
+	}
+	return steps, nil
+}
+
+// lookupJSONPath находит значение по пути в разобранном JSON
+func lookupJSONPath(doc any, path string) (any, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	current := doc
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			obj, ok := current.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: ключ %q ищется не в объекте", path, s)
+			}
+			if current, ok = obj[s]; !ok {
+				return nil, fmt.Errorf("%s: нет ключа %q", path, s)
+			}
+		case int:
+			arr, ok := current.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: индекс [%d] применён не к массиву", path, s)
+			}
+			if s >= len(arr) {
+				return nil, fmt.Errorf("%s: индекс [%d] вне массива из %d элементов", path, s, len(arr))
+			}
+			current = arr[s]
+		}
+	}
+	return current, nil
+}
+
+// parseRatesWithPaths универсальный адаптер: извлекает base, date и rates по путям;
+// незаданные пути заменяются стандартными ключами base, date, rates.
+// Временем курсов считается date, а без неё — момент загрузки
+func parseRatesWithPaths(body []byte, requestedBase string, paths ResponsePaths) (*ExchangeRateResponse, error) {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга JSON: %w", err)
+	}
+	if paths.Rates == "" {
+		paths.Rates = "rates"
+	}
+
+	raw, err := lookupJSONPath(doc, paths.Rates)
+	if err != nil {
+		if msg := providerErrorMessage(body); msg != "" {
+			return nil, fmt.Errorf("провайдер вернул ошибку: %s", msg)
+		}
+		return nil, fmt.Errorf("курсы не найдены: %w", err)
+	}
+	obj, ok := raw.(map[string]any)
+	if !ok || len(obj) == 0 {
+		return nil, fmt.Errorf("%s: ожидается непустой объект {\"EUR\": 0.92, ...}", paths.Rates)
+	}
+	rates := ExchangeRateResponse{Rates: make(map[string]float64, len(obj))}
+	for code, v := range obj {
+		f, err := rateValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", paths.Rates, code, err)
+		}
+		rates.Rates[strings.ToUpper(code)] = f
+	}
+
+	if rates.Base, err = optionalPathString(doc, paths.Base, "base"); err != nil {
+		return nil, err
+	}
+	if rates.Date, err = optionalPathString(doc, paths.Date, "date"); err != nil {
+		return nil, err
+	}
+	if err := normalizeBase(&rates, requestedBase); err != nil {
+		return nil, err
+	}
+	fillUpdateTime(&rates, time.Now())
+	return &rates, nil
+}
+
+// optionalPathString читает строку по явно заданному пути (ошибка, если её нет)
+// или по стандартному ключу (пусто, если его нет)
+func optionalPathString(doc any, path, fallback string) (string, error) {
+	explicit := path != ""
+	if !explicit {
+		path = fallback
+	}
+	v, err := lookupJSONPath(doc, path)
+	if err != nil {
+		if explicit {
+			return "", err
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		if explicit {
+			return "", fmt.Errorf("%s: ожидается строка, получено %v", path, v)
+		}
+		return "", nil
+	}
+	return s, nil
+}
+
+// parseRateValues разбирает объект курсов, где значения — числа или строки с числами
+func parseRateValues(raw map[string]json.RawMessage, field string) (map[string]float64, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	values := make(map[string]float64, len(raw))
+	for code, data := range raw {
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", field, code, err)
+		}
+		f, err := rateValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", field, code, err)
+		}
+		values[code] = f
+	}
+	return values, nil
+}
+
+// rateValue приводит значение курса из JSON к числу; строки вида "92.5" допускаются
+func rateValue(v any) (float64, error) {
+	switch x := v.(type) {
+	case float64:
+		return x, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("курс должен быть числом, получено %q", x)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("курс должен быть числом, получено %v", v)
+}
+
+// isCurrencyCode проверяет, что строка похожа на код валюты ISO 4217
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeBase проверяет поле Base ответа; если провайдер его не указал,
+// базовая валюта берётся из запроса
+func normalizeBase(rates *ExchangeRateResponse, requestedBase string) error {
+	rates.Base = strings.ToUpper(strings.TrimSpace(rates.Base))
+	if rates.Base == "" {
+		if !isCurrencyCode(requestedBase) {
+			return fmt.Errorf("не удалось определить базовую валюту ответа")
+		}
+		rates.Base = requestedBase
+		logVerbose("ℹ️  Провайдер не указал базовую валюту, используется %s из запроса", requestedBase)
+		return nil
+	}
+	if !isCurrencyCode(rates.Base) {
+		return fmt.Errorf("неизвестная базовая валюта в ответе: %q", rates.Base)
+	}
+	if requestedBase != "" && rates.Base != requestedBase {
+		return fmt.Errorf("базовая валюта ответа %s не совпадает с запрошенной %s", rates.Base, requestedBase)
+	}
+	return nil
+}
+
+// addWarning регистрирует предупреждение текущего запуска (см. --strict)
+func addWarning(format string, a ...any) {
+	warnings = append(warnings, fmt.Sprintf(format, a...))
+}
+
+// strictError возвращает ошибку, если за запуск были предупреждения
+func strictError(warnings []string) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+	return fmt.Errorf("--strict: предупреждений: %d\n  - %s", len(warnings), strings.Join(warnings, "\n  - "))
+}
+
+// exitOnWarnings завершает программу с кодом 1, если были предупреждения
+func exitOnWarnings() {
+	if err := strictError(warnings); err != nil {
+		color.New(color.FgRed).Fprintf(os.Stderr, "❌ %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// logVerbose выводит диагностическое сообщение в stderr в режиме --verbose
+func logVerbose(format string, a ...any) {
+	if !verbose {
+		return
+	}
+	color.New(color.FgHiBlack).Fprintf(os.Stderr, format+"\n", a...)
+}
+
+// rebaseFromCache ищет в кэше самую свежую таблицу курсов, содержащую base и все
+// targets (если такой нет — самую свежую с base), и пересчитывает её относительно
+// base (кросс-курс через базис кэша)
+func rebaseFromCache(cache map[string]CacheEntry, base string, targets ...string) (*ExchangeRateResponse, CacheEntry, bool) {
+	var best CacheEntry
+	found, complete := false, false
+	for _, entry := range cache {
+		if rate, ok := entry.Data.Rates[base]; !ok || rate == 0 {
+			continue
+		}
+		hasTargets := true
+		for _, code := range targets {
+			if _, ok := entry.Data.Rates[code]; !ok && code != entry.Data.Base {
+				hasTargets = false
+			}
+		}
+		// Таблица со всеми целевыми валютами важнее более свежей без них
+		better := !found || hasTargets && !complete || hasTargets == complete && entry.FetchedAt.After(best.FetchedAt)
+		if better {
+			best = entry
+			found, complete = true, hasTargets
+		}
+	}
+	if !found {
+		return nil, CacheEntry{}, false
+	}
+
+	pivot := best.Data.Rates[base]
+	rebased := &ExchangeRateResponse{
+		Base:            base,
+		Date:            best.Data.Date,
+		Rates:           make(map[string]float64, len(best.Data.Rates)),
+		TimeLastUpdated: best.Data.TimeLastUpdated,
+	}
+	for code, rate := range best.Data.Rates {
+		rebased.Rates[code] = rate / pivot
+	}
+	rebased.Rates[base] = 1
+	return rebased, best, true
+}
+
+// fillUpdateTime проставляет время курсов, если источник его не прислал:
+// берётся date из ответа, а без неё — now
+func fillUpdateTime(rates *ExchangeRateResponse, now time.Time) {
+	if rates.TimeLastUpdated != 0 {
+		return
+	}
+	rates.TimeLastUpdated = now.Unix()
+	if date, err := time.Parse("2006-01-02", rates.Date); err == nil {
+		rates.TimeLastUpdated = date.Unix()
+	}
+}
+
+// parseStdinRates разбирает таблицу курсов в формате ExchangeRateResponse для --rates-stdin;
+// без time_last_updated временем курсов считается date, а без неё — now
+func parseStdinRates(data []byte, now time.Time) (*ExchangeRateResponse, error) {
+	var rates ExchangeRateResponse
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("неверный JSON: %v", err)
+	}
+	rates.Base = strings.ToUpper(strings.TrimSpace(rates.Base))
+	if !isCurrencyCode(rates.Base) {
+		return nil, fmt.Errorf("неверная базовая валюта %q", rates.Base)
+	}
+	if len(rates.Rates) == 0 {
+		return nil, fmt.Errorf("нет курсов в поле rates")
+	}
+	normalized := make(map[string]float64, len(rates.Rates))
+	for code, rate := range rates.Rates {
+		code = strings.ToUpper(code)
+		if !isCurrencyCode(code) {
+			return nil, fmt.Errorf("неверный код валюты %q в rates", code)
+		}
+		if rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("неверный курс %s: %g", code, rate)
+		}
+		normalized[code] = rate
+	}
+	normalized[rates.Base] = 1
+	rates.Rates = normalized
+	fillUpdateTime(&rates, now)
+	if rates.Provider == "" {
+		rates.Provider = "stdin"
+	}
+	return &rates, nil
+}
+
+// ratesInBase возвращает таблицу курсов в нужной базе; если база другая, курсы
+// пересчитываются через неё: 1 base = R[X]/R[base] X
+func ratesInBase(rates *ExchangeRateResponse, base string) (*ExchangeRateResponse, error) {
+	if rates.Base == base {
+		return rates, nil
+	}
+	pivot, ok := rates.Rates[base]
+	if !ok || pivot == 0 {
+		return nil, fmt.Errorf("курсы даны в базе %s, и курса %s в них нет", rates.Base, base)
+	}
+	rebased := *rates
+	rebased.Base = base
+	rebased.Rates = make(map[string]float64, len(rates.Rates))
+	for code, rate := range rates.Rates {
+		rebased.Rates[code] = rate / pivot
+	}
+	rebased.Rates[base] = 1
+	rebased.Bid, rebased.Ask = nil, nil
+	return &rebased, nil
+}
+
+// ChainResult результат конвертации через промежуточную валюту
+type ChainResult struct {
+	Intermediate  float64 // сумма в промежуточной валюте
+	Result        float64
+	Rate1         float64 // курс from → via
+	Rate2         float64 // курс via → to
+	EffectiveRate float64 // итоговый курс from → to
+}
+
+// roundingMode режим округления при выводе чисел (strconv.FormatFloat)
+const roundingMode = "к ближайшему, ровно половина — к чётной цифре"
+
+// RoundingStep шаг трассировки --explain-rounding
+type RoundingStep struct {
+	Label    string
+	Value    float64
+	Decimals int
+	Rounded  float64
+}
+
+// traceRounding описывает округление значения до decimals знаков так же,
+// как его округляет вывод
+func traceRounding(label string, value float64, decimals int) RoundingStep {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'f', decimals, 64), 64)
+	return RoundingStep{Label: label, Value: value, Decimals: decimals, Rounded: rounded}
+}
+
+// Lines возвращает строки шага: точное значение, режим, точность и результат;
+// если точное значение выглядит как ровная половина, показывается его двоичное
+// представление, из-за которого округление идёт вниз или вверх
+func (s RoundingStep) Lines(locale string) []string {
+	exact := strconv.FormatFloat(s.Value, 'f', -1, 64)
+	lines := []string{
+		fmt.Sprintf("  %s:", s.Label),
+		fmt.Sprintf("    точное значение: %s", exact),
+		fmt.Sprintf("    режим: %s, знаков: %d", roundingMode, s.Decimals),
+		fmt.Sprintf("    итог: %s", formatNumber(s.Value, s.Decimals, locale)),
+	}
+	if _, frac, ok := strings.Cut(exact, "."); ok && len(frac) == s.Decimals+1 && strings.HasSuffix(frac, "5") {
+		lines = append(lines[:3], fmt.Sprintf("    в памяти хранится как %s", strconv.FormatFloat(s.Value, 'f', 20, 64)), lines[3])
+	}
+	return lines
+}
+
+// portfolioRounding трассировка округления итога портфеля; отдельно отмечается,
+// когда сумма округлённых строк не совпадает с округлённым итогом
+func portfolioRounding(values []HoldingValue, total float64, target string) []RoundingStep {
+	var steps []RoundingStep
+	var sumRounded float64
+	for _, v := range values {
+		step := traceRounding("стоимость "+v.Currency, v.Value, 2)
+		sumRounded += step.Rounded
+		steps = append(steps, step)
+	}
+	steps = append(steps, traceRounding("итого, "+target, total, 2))
+	if roundTo(sumRounded, 2) != steps[len(steps)-1].Rounded {
+		steps = append(steps, traceRounding("сумма округлённых строк (итог считается по точным значениям)", sumRounded, 2))
+	}
+	return steps
+}
+
+// printRoundingTrace выводит трассировку --explain-rounding
+func printRoundingTrace(steps []RoundingStep, locale string) {
+	fmt.Println()
+	color.HiBlack("🔍 Округление:")
+	for _, step := range steps {
+		for _, line := range step.Lines(locale) {
+			color.HiBlack("%s", line)
+		}
+	}
+}
+
+// roundTo округляет значение до decimals знаков после запятой
+func roundTo(value float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(value*p) / p
+}
+
+// convertChain конвертирует сумму в два шага; при roundIntermediate
+// промежуточная сумма округляется до 2 знаков, иначе считается без округления
+func convertChain(amount, rate1, rate2 float64, roundIntermediate bool) ChainResult {
+	intermediate := amount * rate1
+	if roundIntermediate {
+		intermediate = roundTo(intermediate, 2)
+	}
+	result := intermediate * rate2
+	effective := rate1 * rate2
+	if amount != 0 {
+		effective = result / amount
+	}
+	return ChainResult{
+		Intermediate:  intermediate,
+		Result:        result,
+		Rate1:         rate1,
+		Rate2:         rate2,
+		EffectiveRate: effective,
+	}
+}
+
+// compactRate возвращает курс пары <from> <to> для --compact-rate-only;
+// сохранённые курсы используются независимо от их возраста, API — только
+// если кэша нет или задан --no-cache
+func compactRate(args []string) (float64, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("нужны аргументы <from> <to>")
+	}
+	from, to := strings.ToUpper(args[0]), strings.ToUpper(args[1])
+	var rates *ExchangeRateResponse
+	var err error
+	if !noCache {
+		rates, err = getExchangeRates(from, true, true)
+	}
+	if noCache || err != nil {
+		rates, err = getExchangeRates(from, true, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	rate, ok := rates.Rates[to]
+	if !ok {
+		return 0, fmt.Errorf("валюта %s не найдена", to)
+	}
+	return rate, nil
+}
+
+// impliedRate считает курс по двум известным суммам: target / source
+func impliedRate(source, target float64) (float64, error) {
+	if source == 0 {
+		return 0, fmt.Errorf("исходная сумма не может быть нулевой")
+	}
+	if source < 0 || target < 0 {
+		return 0, fmt.Errorf("суммы не могут быть отрицательными")
+	}
+	return target / source, nil
+}
+
+// requiredAmount возвращает сумму в исходной валюте, дающую target по курсу rate
+func requiredAmount(target, rate float64) (float64, error) {
+	if rate <= 0 {
+		return 0, fmt.Errorf("курс равен нулю — расчёт невозможен")
+	}
+	return target / rate, nil
+}
+
+// convertCurrency конвертирует валюту
+func convertCurrency(amount float64, _ string, to string, rates *ExchangeRateResponse) (float64, error) {
+	if rate, ok := rates.Rates[to]; ok {
+		return amount * rate, nil
+	}
+	return 0, fmt.Errorf("валюта %s не найдена", to)
+}
+
+// formatTimeAgo форматирует время, прошедшее с момента обновления
+func formatTimeAgo(duration time.Duration) string {
+	hours := int(duration.Hours())
+	minutes := int(duration.Minutes()) % 60
+
+	if hours > 24 {
+		days := hours / 24
+		if days == 1 {
+			return "1 день назад"
+		}
+		return fmt.Sprintf("%d дня/дней назад", days)
+	}
+
+	if hours > 0 {
+		if hours == 1 {
+			return "1 час назад"
+		}
+		if hours < 5 {
+			return fmt.Sprintf("%d часа назад", hours)
+		}
+		return fmt.Sprintf("%d часов назад", hours)
+	}
+
+	if minutes > 0 {
+		if minutes == 1 {
+			return "1 минуту назад"
+		}
+		if minutes < 5 {
+			return fmt.Sprintf("%d минуты назад", minutes)
+		}
+		return fmt.Sprintf("%d минут назад", minutes)
+	}
+
+	return "только что"
+}
+
+// selfTestFixture встроенный ответ провайдера для --self-test
+const selfTestFixture = `{"base":"USD","date":"2024-01-02","time_last_updated":1704153600,
+"rates":{"USD":1,"EUR":0.92,"RUB":"92.5","JPY":150}}`
+
+// selfCheck одна проверка --self-test
+type selfCheck struct {
+	name string
+	run  func() error
+}
+
+// expectFloat сравнивает числа с допуском на погрешность float64
+func expectFloat(got, want float64) error {
+	if math.Abs(got-want) > 1e-9 {
+		return fmt.Errorf("получено %v, ожидалось %v", got, want)
+	}
+	return nil
+}
+
+// expectString сравнивает строки
+func expectString(got, want string) error {
+	if got != want {
+		return fmt.Errorf("получено %q, ожидалось %q", got, want)
+	}
+	return nil
+}
+
+// selfTestChecks проверки ядра: разбор ответа, конвертация, кросс-курс, округление,
+// форматирование времени и чисел
+func selfTestChecks() []selfCheck {
+	fixture := func() *ExchangeRateResponse {
+		rates, err := parseRatesResponse([]byte(selfTestFixture), "USD")
+		if err != nil {
+			panic(err)
+		}
+		return rates
+	}
+	return []selfCheck{
+		{"разбор ответа провайдера", func() error {
+			rates, err := parseRatesResponse([]byte(selfTestFixture), "USD")
+			if err != nil {
+				return err
+			}
+			if len(rates.Rates) != 4 {
+				return fmt.Errorf("ожидалось 4 курса, получено %d", len(rates.Rates))
+			}
+			return nil
+		}},
+		{"конвертация USD → EUR", func() error {
+			result, err := convertCurrency(100, "USD", "EUR", fixture())
+			if err != nil {
+				return err
+			}
+			return expectFloat(result, 92)
+		}},
+		{"неизвестная валюта", func() error {
+			if _, err := convertCurrency(1, "USD", "XXX", fixture()); err == nil {
+				return fmt.Errorf("ожидалась ошибка")
+			}
+			return nil
+		}},
+		{"кросс-курс EUR → RUB через USD", func() error {
+			cache := map[string]CacheEntry{"USD": {FetchedAt: time.Now(), Data: *fixture()}}
+			rebased, _, ok := rebaseFromCache(cache, "EUR")
+			if !ok {
+				return fmt.Errorf("пересчёт через базис не выполнен")
+			}
+			return expectFloat(roundTo(rebased.Rates["RUB"], 6), 100.543478)
+		}},
+		{"цепочка USD → EUR → JPY", func() error {
+			chain := convertChain(100, 0.92, 150/0.92, true)
+			return expectFloat(roundTo(chain.Result, 2), 15000)
+		}},
+		{"округление", func() error {
+			if err := expectFloat(roundTo(92.456, 2), 92.46); err != nil {
+				return err
+			}
+			return expectFloat(roundTo(-1.25, 1), -1.3)
+		}},
+		{"formatTimeAgo", func() error {
+			for d, want := range map[time.Duration]string{
+				30 * time.Second: "только что",
+				3 * time.Minute:  "3 минуты назад",
+				time.Hour:        "1 час назад",
+				50 * time.Hour:   "2 дня/дней назад",
+			} {
+				if err := expectString(formatTimeAgo(d), want); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"форматирование по локали", func() error {
+			return expectString(formatNumber(1234567.891, 2, "de-DE"), "1.234.567,89")
+		}},
+	}
+}
+
+// runSelfTest выполняет проверки и печатает результат каждой; паника в проверке
+// считается провалом
+func runSelfTest(out io.Writer, checks []selfCheck) (passed, failed int) {
+	for _, c := range checks {
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("паника: %v", r)
+				}
+			}()
+			return c.run()
+		}()
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "❌ %s: %v\n", c.name, err)
+			continue
+		}
+		passed++
+		fmt.Fprintf(out, "✅ %s\n", c.name)
+	}
+	fmt.Fprintf(out, "\nПроверок: %d, пройдено: %d, провалено: %d\n", passed+failed, passed, failed)
+	return passed, failed
+}
+
+// printTable выводит результаты конвертации в виде таблицы; числа форматируются по локали,
+// курс — с точностью --precision-rate
+func printTable(amount float64, from string, rows []TableRow, rates *ExchangeRateResponse, opts Options) {
+	whole, locale := opts.Whole, opts.Locale
+	fmt.Println()
 	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("Использование:")
+	fmt.Printf("  Конвертация %s %s\n", formatNumber(amount, 2, locale), from)
+	fmt.Println("  ┌──────────┬────────────────┬──────────────┐")
+	fmt.Println("  │ Валюта   │ Результат      │ Курс         │")
+	fmt.Println("  ├──────────┼────────────────┼──────────────┤")
 	color.Unset()
-	fmt.Println("  go run main.go [флаги] <from> <to> <amount>")
-	fmt.Println("  go run main.go [флаги] <from> <to1,to2,...> <amount>")
+	for _, row := range rows {
+		color.Green("  │ %-8s │ %-14s │ %-12s │", row.Currency, formatNumber(row.Result, resultDecimals(row.Currency, whole), locale), formatNumber(row.Rate, opts.PrecisionRate, locale))
+	}
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("  └──────────┴────────────────┴──────────────┘")
+	color.Unset()
+
+	updateTime := time.Unix(rates.TimeLastUpdated, 0)
+	timeAgo := formatTimeAgo(time.Since(updateTime))
+	fmt.Println()
+	color.HiBlack("  Последнее обновление: %s (%s)", updateTime.Format("2006-01-02 15:04:05"), timeAgo)
+	color.HiBlack("  Источник: %s", providerLabel(rates))
+	fmt.Println()
+}
+
+// resultDecimals число знаков для показа результата: 0 для валют из --whole, затем minor_units конфига,
+// затем встроенный справочник (JPY — 0, KWD — 3), иначе 2; влияет только на вывод, расчёты идут без округления
+func resultDecimals(code string, whole []string) int {
+	if containsString(whole, code) {
+		return 0
+	}
+	if info, err := lookupCurrency(code); err == nil {
+		return info.MinorUnits
+	}
+	return 2
+}
+
+// providerLabel формирует подпись источника курсов: провайдер и признак кэша
+func providerLabel(rates *ExchangeRateResponse) string {
+	provider := rates.Provider
+	if provider == "" {
+		provider = providerName
+	}
+	if rates.Cached {
+		return provider + " (кэш)"
+	}
+	return provider
+}
+
+// sortedCurrencies возвращает коды валют из ответа API в алфавитном порядке
+func sortedCurrencies(rates *ExchangeRateResponse) []string {
+	codes := make([]string, 0, len(rates.Rates))
+	for code := range rates.Rates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// nonEmptyCodes убирает пробелы и пустые элементы из списка кодов валют
+func nonEmptyCodes(codes []string) []string {
+	var result []string
+	for _, code := range codes {
+		code = strings.TrimSpace(code)
+		if code != "" {
+			result = append(result, code)
+		}
+	}
+	return result
+}
+
+// containsString проверяет, что значение есть в списке
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortTargets упорядочивает целевые валюты для --output-sort: value — по убыванию
+// курса, code — по алфавиту, input и пустой режим — как задано (для --all это алфавит)
+func sortTargets(codes []string, rates *ExchangeRateResponse, mode string) []string {
+	sorted := append([]string(nil), codes...)
+	switch mode {
+	case "value":
+		sort.SliceStable(sorted, func(i, j int) bool { return rates.Rates[sorted[i]] > rates.Rates[sorted[j]] })
+	case "code":
+		sort.Strings(sorted)
+	}
+	return sorted
+}
+
+// sortBatchResults упорядочивает результаты пакета для --output-sort: input и пустой
+// режим — порядок файла, value — по убыванию результата (строки с ошибкой в конце),
+// code — по целевой валюте
+func sortBatchResults(results []BatchResult, mode string) {
+	switch mode {
+	case "value":
+		sort.SliceStable(results, func(i, j int) bool {
+			if (results[i].Error == "") != (results[j].Error == "") {
+				return results[i].Error == ""
+			}
+			return results[i].Result > results[j].Result
+		})
+	case "code":
+		sort.SliceStable(results, func(i, j int) bool { return results[i].To < results[j].To })
+	default:
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Line < results[j].Line })
+	}
+}
+
+// limitTargets оставляет первые limit кодов и возвращает число отброшенных;
+// limit == 0 означает отсутствие ограничения
+func limitTargets(codes []string, limit int) ([]string, int) {
+	if limit == 0 || len(codes) <= limit {
+		return codes, 0
+	}
+	return codes[:limit], len(codes) - limit
+}
+
+// printOmittedNote сообщает, сколько валют скрыто ограничением --max-targets;
+// в машиночитаемых форматах сообщение уходит в stderr
+func printOmittedNote(omitted int, quiet bool) {
+	if omitted == 0 {
+		return
+	}
+	if quiet {
+		fmt.Fprintf(os.Stderr, "... ещё %d валют скрыто (--max-targets)\n", omitted)
+		return
+	}
+	color.HiBlack("  ... ещё %d валют скрыто (--max-targets)", omitted)
+}
+
+// currenciesSummary формирует итоговую строку о количестве доступных валют
+func currenciesSummary(rates *ExchangeRateResponse) string {
+	updateTime := time.Unix(rates.TimeLastUpdated, 0)
+	return fmt.Sprintf("Доступно валют: %d (по состоянию на %s)", len(rates.Rates), updateTime.Format("2006-01-02"))
+}
+
+// printCurrenciesSummary выводит итоговую строку для --list/--all
+func printCurrenciesSummary(rates *ExchangeRateResponse) {
+	color.HiBlack("  %s", currenciesSummary(rates))
+	fmt.Println()
+}
+
+// printRatesList выводит все курсы для базовой валюты в виде таблицы
+func printRatesList(base string, rates *ExchangeRateResponse, locale string) {
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Printf("  Курсы для 1 %s\n", base)
+	fmt.Println("  ┌──────────┬──────────────┐")
+	fmt.Println("  │ Валюта   │ Курс         │")
+	fmt.Println("  ├──────────┼──────────────┤")
+	color.Unset()
+	for _, code := range sortedCurrencies(rates) {
+		color.Green("  │ %-8s │ %-12s │", code, formatNumber(rates.Rates[code], 4, locale))
+	}
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("  └──────────┴──────────────┘")
+	color.Unset()
+	fmt.Println()
+}
+
+// FlatRate курс валюты к общей базе в сведённой таблице --flatten
+type FlatRate struct {
+	Currency  string    `json:"currency"`
+	Rate      float64   `json:"rate"`   // 1 база = Rate валюты
+	Source    string    `json:"source"` // база закэшированной таблицы, из которой взят курс
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// flattenCache переводит все таблицы кэша в одну базу: таблица с базой B даёт
+// курсы 1 base = R[X]/R[base] X. Если валюта есть в нескольких таблицах, берётся
+// самая свежая. Таблицы без курса base возвращаются в skipped
+func flattenCache(cache map[string]CacheEntry, base string) (flat []FlatRate, skipped []string, err error) {
+	best := make(map[string]FlatRate)
+	keys := make([]string, 0, len(cache))
+	for k := range cache {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := cache[key]
+		source := entry.Data.Base
+		if source == "" {
+			source = key
+		}
+		rates := map[string]float64{source: 1}
+		for code, rate := range entry.Data.Rates {
+			rates[code] = rate
+		}
+		pivot := rates[base]
+		if pivot <= 0 {
+			skipped = append(skipped, source)
+			continue
+		}
+		for code, rate := range rates {
+			if code == base {
+				continue
+			}
+			if prev, ok := best[code]; ok && !entry.FetchedAt.After(prev.FetchedAt) {
+				continue
+			}
+			best[code] = FlatRate{Currency: code, Rate: rate / pivot, Source: source, FetchedAt: entry.FetchedAt}
+		}
+	}
+	if len(best) == 0 {
+		return nil, skipped, fmt.Errorf("в кэше нет таблиц, которые можно выразить через %s", base)
+	}
+	for _, r := range best {
+		flat = append(flat, r)
+	}
+	sort.Slice(flat, func(i, j int) bool { return flat[i].Currency < flat[j].Currency })
+	return flat, skipped, nil
+}
+
+// writeFlatCSV пишет сведённую таблицу: currency,rate,source,fetched_at
+func writeFlatCSV(out io.Writer, flat []FlatRate) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"currency", "rate", "source", "fetched_at"})
+	for _, r := range flat {
+		w.Write([]string{r.Currency, strconv.FormatFloat(r.Rate, 'f', -1, 64), r.Source, r.FetchedAt.UTC().Format(time.RFC3339)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeMoversCSV выводит --top-movers в CSV с заголовком
+func writeMoversCSV(out io.Writer, movers []Mover) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"currency", "old_rate", "new_rate", "change_percent"})
+	for _, m := range movers {
+		w.Write([]string{m.Currency, strconv.FormatFloat(m.OldRate, 'f', -1, 64),
+			strconv.FormatFloat(m.NewRate, 'f', -1, 64), strconv.FormatFloat(m.Change, 'f', -1, 64)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// printFlatRates выводит сведённую таблицу курсов; курсы форматируются по локали
+func printFlatRates(base string, flat []FlatRate, locale string) {
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Printf("  Курсы для 1 %s из всех таблиц кэша\n", base)
+	fmt.Println("  ┌──────────┬──────────────┬──────────┬──────────────────┐")
+	fmt.Println("  │ Валюта   │ Курс         │ Из       │ Загружено        │")
+	fmt.Println("  ├──────────┼──────────────┼──────────┼──────────────────┤")
+	color.Unset()
+	for _, r := range flat {
+		color.Green("  │ %-8s │ %-12s │ %-8s │ %-16s │", r.Currency, formatNumber(r.Rate, 4, locale), r.Source, r.FetchedAt.Format("2006-01-02 15:04"))
+	}
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("  └──────────┴──────────────┴──────────┴──────────────────┘")
+	color.Unset()
+	fmt.Println()
+}
+
+// outputRatesJSON выводит все курсы для базовой валюты в формате JSON
+func outputRatesJSON(base string, rates *ExchangeRateResponse) {
+	output := map[string]any{
+		"success":          true,
+		"base":             base,
+		"rates":            rates.Rates,
+		"rate_update_time": time.Unix(rates.TimeLastUpdated, 0),
+	}
+	data, _ := json.MarshalIndent(output, "", "  ")
+	fmt.Println(string(data))
+}
+
+// outputRatesCSV выводит все курсы для базовой валюты в формате CSV
+func outputRatesCSV(rates *ExchangeRateResponse) {
+	// currency,rate
+	for _, code := range sortedCurrencies(rates) {
+		fmt.Printf("%s,%.6f\n", code, rates.Rates[code])
+	}
+}
+
+// formatInverseRate форматирует обратный курс с заданной точностью; если
+// значение округляется до нуля, точность увеличивается до maxInversePrecision
+func formatInverseRate(inverse float64, precision int, locale string) string {
+	text := strconv.FormatFloat(inverse, 'f', precision, 64)
+	for inverse > 0 && precision < maxInversePrecision && strings.Trim(text, "0.") == "" {
+		precision++
+		text = strconv.FormatFloat(inverse, 'f', precision, 64)
+	}
+	return formatNumber(inverse, precision, locale)
+}
+
+// renderMarkdown формирует таблицу GitHub-flavored Markdown; первый столбец
+// выравнивается по левому краю, числовые — по правому
+func renderMarkdown(headers []string, rows [][]string) string {
+	widths := make([]int, len(headers))
+	for i, h := range headers {
+		widths[i] = max(utf8.RuneCountInString(h), 3)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	pad := func(text string, width int, right bool) string {
+		fill := strings.Repeat(" ", width-utf8.RuneCountInString(text))
+		if right {
+			return fill + text
+		}
+		return text + fill
+	}
+
+	var b strings.Builder
+	writeRow := func(cells []string) {
+		b.WriteString("|")
+		for i, cell := range cells {
+			b.WriteString(" " + pad(cell, widths[i], i > 0) + " |")
+		}
+		b.WriteString("\n")
+	}
+
+	writeRow(headers)
+	b.WriteString("|")
+	for i, w := range widths {
+		if i > 0 {
+			b.WriteString(" " + strings.Repeat("-", w-1) + ": |")
+		} else {
+			b.WriteString(" " + strings.Repeat("-", w) + " |")
+		}
+	}
+	b.WriteString("\n")
+	for _, row := range rows {
+		writeRow(row)
+	}
+	return b.String()
+}
+
+// renderMarkdownTable формирует Markdown-таблицу результатов конвертации;
+// курс выводится с rateDecimals знаками, changes (для --since-last-run) добавляет колонку изменения курса
+func renderMarkdownTable(rows []TableRow, whole []string, rateDecimals int, changes []string) string {
+	headers := []string{"Валюта", "Результат", "Курс"}
+	if changes != nil {
+		headers = append(headers, "Изменение")
+	}
+	cells := make([][]string, 0, len(rows))
+	for i, row := range rows {
+		cell := []string{
+			row.Currency,
+			strconv.FormatFloat(row.Result, 'f', resultDecimals(row.Currency, whole), 64),
+			strconv.FormatFloat(row.Rate, 'f', rateDecimals, 64),
+		}
+		if changes != nil {
+			cell = append(cell, changes[i])
+		}
+		cells = append(cells, cell)
+	}
+	return renderMarkdown(headers, cells)
+}
+
+// renderMarkdownBatch формирует Markdown-таблицу результатов --batch;
+// колонка «Ошибка» добавляется, только если есть строки с ошибкой
+func renderMarkdownBatch(results []BatchResult, opts Options) string {
+	headers := []string{"Строка", "Сумма", "Из", "В", "Результат", "Курс"}
+	withErrors := false
+	for _, r := range results {
+		withErrors = withErrors || r.Error != ""
+	}
+	if withErrors {
+		headers = append(headers, "Ошибка")
+	}
+	cells := make([][]string, 0, len(results))
+	for _, r := range results {
+		row := []string{strconv.Itoa(r.Line), strconv.FormatFloat(r.Amount, 'f', 2, 64), r.From, r.To, "", ""}
+		if r.Error == "" {
+			row[4] = strconv.FormatFloat(r.Result, 'f', resultDecimals(r.To, opts.Whole), 64)
+			row[5] = strconv.FormatFloat(r.Rate, 'f', opts.PrecisionRate, 64)
+		}
+		if withErrors {
+			row = append(row, strings.ReplaceAll(r.Error, "|", `\|`))
+		}
+		cells = append(cells, row)
+	}
+	return renderMarkdown(headers, cells)
+}
+
+// renderMarkdownPortfolio формирует Markdown-таблицу --portfolio с итоговой строкой
+func renderMarkdownPortfolio(values []HoldingValue, total float64, opts Options) string {
+	cells := make([][]string, 0, len(values)+1)
+	for _, v := range values {
+		cells = append(cells, []string{
+			v.Currency,
+			strconv.FormatFloat(v.Amount, 'f', 2, 64),
+			strconv.FormatFloat(v.Value, 'f', 2, 64),
+			strconv.FormatFloat(v.Rate, 'f', opts.PrecisionRate, 64),
+		})
+	}
+	cells = append(cells, []string{"Итого", "", strconv.FormatFloat(total, 'f', 2, 64), ""})
+	return renderMarkdown([]string{"Валюта", "Сумма", "Стоимость", "Курс"}, cells)
+}
+
+// renderMarkdownRates формирует Markdown-таблицу всех курсов для --list
+func renderMarkdownRates(rates *ExchangeRateResponse) string {
+	var cells [][]string
+	for _, code := range sortedCurrencies(rates) {
+		cells = append(cells, []string{code, strconv.FormatFloat(rates.Rates[code], 'f', 4, 64)})
+	}
+	return renderMarkdown([]string{"Валюта", "Курс"}, cells)
+}
+
+// projectedRate возвращает прогнозный курс для --convert-and-hold
+func projectedRate(current float64, opts Options) float64 {
+	if opts.HoldPercent {
+		return current * (1 + opts.HoldValue/100)
+	}
+	return opts.HoldValue
+}
+
+// simulateHold сравнивает стоимость суммы по текущему и прогнозному курсу
+func simulateHold(amount, currentRate, futureRate float64) (current, projected, diff float64) {
+	current = amount * currentRate
+	projected = amount * futureRate
+	return current, projected, projected - current
+}
+
+// magnitudeHint подсказывает более удобное представление, если результат
+// по модулю не меньше порога; пустая строка — подсказка не нужна
+func magnitudeHint(result, threshold float64, to string) string {
+	if threshold <= 0 || math.Abs(result) < threshold {
+		return ""
+	}
+	return fmt.Sprintf("⚠️  Очень большое число: ≈ %s %s (%s); возможно, удобнее меньшая сумма или валюта крупнее",
+		strconv.FormatFloat(result, 'e', 2, 64), to, magnitudeWord(math.Abs(result)))
+}
+
+// magnitudeWord называет порядок числа словами: тыс., млн, млрд, трлн
+func magnitudeWord(value float64) string {
+	switch {
+	case value >= 1e12:
+		return fmt.Sprintf("%.1f трлн", value/1e12)
+	case value >= 1e9:
+		return fmt.Sprintf("%.1f млрд", value/1e9)
+	case value >= 1e6:
+		return fmt.Sprintf("%.1f млн", value/1e6)
+	case value >= 1e3:
+		return fmt.Sprintf("%.1f тыс.", value/1e3)
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// midQuote считает mid и спред по bid/ask провайдера; false, если котировки нет
+func midQuote(rates *ExchangeRateResponse, to string, rate float64) (MidQuote, bool) {
+	bid, okBid := rates.Bid[to]
+	ask, okAsk := rates.Ask[to]
+	if !okBid || !okAsk || bid <= 0 || ask < bid {
+		return MidQuote{}, false
+	}
+	mid := (bid + ask) / 2
+	return MidQuote{
+		Bid:           bid,
+		Ask:           ask,
+		Mid:           mid,
+		SpreadPercent: (ask - bid) / mid * 100,
+		RateVsMid:     (rate - mid) / mid * 100,
+	}, true
+}
+
+// printMidQuote выводит bid/ask, mid и спред для --compare-to-mid
+func printMidQuote(to string, rates *ExchangeRateResponse, rate float64, opts Options) {
+	q, ok := midQuote(rates, to, rate)
+	if !ok {
+		color.HiBlack("ℹ️  %s не отдаёт bid/ask для %s — сравнение с mid недоступно", providerLabel(rates), to)
+		return
+	}
+	num := func(value float64) string { return formatNumber(value, opts.PrecisionRate, opts.Locale) }
+	color.Cyan("Bid: %s  Ask: %s  Mid: %s", num(q.Bid), num(q.Ask), num(q.Mid))
+	color.Cyan("Спред: %s, ваш курс отличается от mid на %s", formatPercent(q.SpreadPercent, false), formatPercent(q.RateVsMid, true))
+}
+
+// printHoldSimulation выводит результат симуляции «конвертировать позже»
+func printHoldSimulation(amount float64, from, to string, rate float64, opts Options) {
+	future := projectedRate(rate, opts)
+	current, projected, diff := simulateHold(amount, rate, future)
+	fmt.Println()
+	color.Set(color.FgMagenta, color.Bold)
+	num := func(value float64, decimals int) string { return formatNumber(value, decimals, opts.Locale) }
+	fmt.Printf("🧪 СИМУЛЯЦИЯ (%s → %s, курс %s → %s)\n", from, to, num(rate, 4), num(future, 4))
+	color.Unset()
+	sign := ""
+	if diff >= 0 {
+		sign = "+"
+	}
+	color.Magenta("   Сейчас:      %s %s", num(current, 2), to)
+	color.Magenta("   По прогнозу: %s %s", num(projected, 2), to)
+	color.Magenta("   Разница:     %s%s %s", sign, num(diff, 2), to)
+}
+
+// printChainResult выводит результат конвертации через промежуточную валюту
+func printChainResult(amount float64, from, via, to string, chain ChainResult, roundIntermediate bool, locale string) {
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("════════════════ РЕЗУЛЬТАТ ════════════════")
+	color.Unset()
+
+	num := func(value float64, decimals int) string { return formatNumber(value, decimals, locale) }
+	color.Green("%s %s = %s %s (через %s)", num(amount, 2), from, num(chain.Result, 2), to, via)
+	fmt.Println()
+	mode := "без округления"
+	if roundIntermediate {
+		mode = "с округлением до 2 знаков"
+	}
+	color.Cyan("Шаг 1: %s %s × %s = %s %s (%s)", num(amount, 2), from, num(chain.Rate1, 4), num(chain.Intermediate, 4), via, mode)
+	color.Cyan("Шаг 2: %s %s × %s = %s %s", num(chain.Intermediate, 4), via, num(chain.Rate2, 4), num(chain.Result, 2), to)
+	color.Cyan("Итоговый курс: 1 %s = %s %s", from, num(chain.EffectiveRate, 6), to)
+
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("═══════════════════════════════════════════")
+	color.Unset()
+}
+
+// pairNotation формирует котировку в FX-нотации: USDRUB=92.5000
+func pairNotation(from, to string, rate float64, precision int) string {
+	return from + to + "=" + strconv.FormatFloat(rate, 'f', precision, 64)
+}
+
+// invoiceLine формирует строку для счёта:
+// Service (USD 100.00) → RUB 9,250.00 at 92.5000 on 2024-01-02
+func invoiceLine(amount float64, from string, result float64, to string, rate float64, date string, opts Options) string {
+	return fmt.Sprintf("%s (%s %s) → %s %s at %s on %s", opts.InvoiceLabel,
+		from, formatNumber(amount, 2, opts.Locale),
+		to, formatNumber(result, resultDecimals(to, opts.Whole), opts.Locale),
+		formatNumber(rate, opts.PrecisionRate, opts.Locale), date)
+}
+
+// fixedColumns ширины полей формата fixed: сумма, из, в, результат, курс
+var fixedColumns = struct{ Amount, From, To, Result, Rate int }{15, 4, 4, 18, 16}
+
+// fixedNumber форматирует число для поля фиксированной ширины: без разделителей
+// тысяч, с точкой, по правому краю; не помещающееся число заменяется звёздочками
+func fixedNumber(value float64, decimals, width int) string {
+	text := strconv.FormatFloat(value, 'f', decimals, 64)
+	if len(text) > width {
+		return strings.Repeat("*", width)
+	}
+	return padLeft(text, width)
+}
+
+// fixedText обрезает или дополняет текстовое поле до ширины, выравнивая по левому краю
+func fixedText(text string, width int) string {
+	if runes := []rune(text); len(runes) > width {
+		return string(runes[:width])
+	}
+	return padRight(text, width)
+}
+
+// fixedLine формирует строку формата fixed для старых парсеров логов
+func fixedLine(amount float64, from, to string, result, rate float64, opts Options) string {
+	return fixedNumber(amount, 2, fixedColumns.Amount) +
+		fixedText(" "+from, fixedColumns.From) +
+		fixedText(" "+to, fixedColumns.To) +
+		fixedNumber(result, resultDecimals(to, opts.Whole), fixedColumns.Result) +
+		fixedNumber(rate, opts.PrecisionRate, fixedColumns.Rate)
+}
+
+// rateDate дата курсов: из ответа провайдера или по времени обновления
+func rateDate(rates *ExchangeRateResponse) string {
+	if rates.Date != "" {
+		return rates.Date
+	}
+	return time.Unix(rates.TimeLastUpdated, 0).Format("2006-01-02")
+}
+
+// padLeft дополняет строку пробелами слева до width символов (с учётом рун)
+func padLeft(text string, width int) string {
+	if n := utf8.RuneCountInString(text); n < width {
+		return strings.Repeat(" ", width-n) + text
+	}
+	return text
+}
+
+// padRight дополняет строку пробелами справа до width символов (с учётом рун)
+func padRight(text string, width int) string {
+	if n := utf8.RuneCountInString(text); n < width {
+		return text + strings.Repeat(" ", width-n)
+	}
+	return text
+}
+
+// alignWidths считает ширину результата и курса по всем целевым валютам для --align;
+// для одной валюты выравнивание не нужно и возвращаются нули
+func alignWidths(amount float64, targets []string, rates *ExchangeRateResponse, opts Options) (resultWidth, rateWidth int) {
+	if len(targets) < 2 {
+		return 0, 0
+	}
+	for _, code := range targets {
+		rate, ok := rates.Rates[strings.TrimSpace(code)]
+		if !ok {
+			continue
+		}
+		result := formatNumber(amount*rate, resultDecimals(code, opts.Whole), opts.Locale)
+		resultWidth = max(resultWidth, utf8.RuneCountInString(result))
+		rateWidth = max(rateWidth, utf8.RuneCountInString(formatNumber(rate, opts.PrecisionRate, opts.Locale)))
+	}
+	return resultWidth, rateWidth
+}
+
+// rateLines формирует строки прямого и обратного курса с разделителями локали
+func rateLines(from, to string, rate float64, opts Options) []string {
+	shown := padLeft(formatNumber(rate, opts.PrecisionRate, opts.Locale), opts.RateWidth)
+	lines := []string{fmt.Sprintf("Курс: 1 %s = %s %s", from, shown, to)}
+	if rate != 0 {
+		lines = append(lines, fmt.Sprintf("Обратный курс: 1 %s = %s %s",
+			to, formatInverseRate(1/rate, opts.PrecisionInverse, opts.Locale), from))
+	}
+	if opts.AsFraction && rate > 0 {
+		num, den := bestFraction(rate, opts.MaxDenominator)
+		sign := "≈"
+		if float64(num)/float64(den) == rate {
+			sign = "="
+		}
+		lines = append(lines, fmt.Sprintf("Дробью: 1 %s %s %d/%d %s (%s)", from, sign, num, den, to,
+			formatNumber(rate, opts.PrecisionRate, opts.Locale)))
+	}
+	return lines
+}
+
+// bestFraction возвращает наилучшее рациональное приближение x > 0 со знаменателем
+// не больше maxDen: подходящие дроби цепной дроби и, на последнем шаге, промежуточная
+func bestFraction(x float64, maxDen int64) (num, den int64) {
+	h0, h1 := int64(0), int64(1)
+	k0, k1 := int64(1), int64(0)
+	value := x
+	for {
+		a := int64(math.Floor(value))
+		if k1 != 0 && a*k1+k0 > maxDen {
+			// Промежуточная дробь с наибольшим допустимым знаменателем
+			t := (maxDen - k0) / k1
+			hs, ks := h0+t*h1, k0+t*k1
+			if math.Abs(x-float64(hs)/float64(ks)) < math.Abs(x-float64(h1)/float64(k1)) {
+				return hs, ks
+			}
+			return h1, k1
+		}
+		h0, h1 = h1, a*h1+h0
+		k0, k1 = k1, a*k1+k0
+		frac := value - float64(a)
+		if frac < 1e-12 || math.Abs(x-float64(h1)/float64(k1)) < 1e-15*x {
+			return h1, k1
+		}
+		value = 1 / frac
+	}
+}
+
+// rateRoundingNote поясняет расхождение, если сумма × показанный (округлённый) курс
+// отличается от результата, посчитанного по точному курсу, хотя бы на 0.01; только
+// при явно заданной точности курса, чтобы обычный вывод не менялся
+func rateRoundingNote(amount, rate, result float64, opts Options) string {
+	if !opts.RatePrecisionSet {
+		return ""
+	}
+	shown := roundTo(rate, opts.PrecisionRate)
+	diff := amount*shown - result
+	if math.Abs(diff) < 0.005 {
+		return ""
+	}
+	return fmt.Sprintf("ℹ️  Результат посчитан по точному курсу %s; по показанному курсу вышло бы %s (разница %s)",
+		strconv.FormatFloat(rate, 'f', -1, 64), formatNumber(amount*shown, 2, opts.Locale), formatNumber(diff, 2, opts.Locale))
+}
+
+// printResult выводит результат конвертации
+func printResult(amount float64, from string, result float64, to string, rates *ExchangeRateResponse, opts Options) {
+	fmt.Println()
+	color.Set(color.FgYellow, color.Bold)
+	fmt.Println("════════════════ РЕЗУЛЬТАТ ════════════════")
+	color.Unset()
+
+	color.Green("%s %s = %s %s", formatNumber(amount, 2, opts.Locale), from,
+		padLeft(formatNumber(result, resultDecimals(to, opts.Whole), opts.Locale), opts.ResultWidth), to)
+
+	if rate, ok := rates.Rates[to]; ok {
+		fmt.Println()
+		rateColor := color.FgCyan
+		if opts.ColorByMovement {
+			if snap, found := referenceSnapshot(loadSnapshots()[from], rates); found {
+				rateColor = movementColor(rate, snap.Rates[to])
+			}
+		}
+		for i, line := range rateLines(from, to, rate, opts) {
+			if i == 0 {
+				color.New(rateColor).Println(line)
+				continue
+			}
+			color.Cyan("%s", line)
+		}
+		if note := rateRoundingNote(amount, rate, result, opts); note != "" {
+			color.HiBlack("%s", note)
+		}
+		if opts.PairNotation {
+			color.Cyan("%s", pairNotation(from, to, rate, opts.PrecisionRate))
+		}
+		if opts.ExplainRounding {
+			printRoundingTrace([]RoundingStep{
+				traceRounding("результат, "+to, result, resultDecimals(to, opts.Whole)),
+				traceRounding("курс "+from+"/"+to, rate, opts.PrecisionRate),
+			}, opts.Locale)
+		}
+	}
+
+	// Вывод времени последнего обновления
+	updateTime := time.Unix(rates.TimeLastUpdated, 0)
+	age := time.Since(updateTime)
+	fmt.Println()
+	color.New(stalenessColor(age, opts.StaleWarnAfter, opts.StaleAfter)).Printf("Последнее обновление: %s (%s)\n",
+		updateTime.Format("2006-01-02 15:04:05"), formatTimeAgo(age))
+
 	fmt.Println()
 	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("Флаги вывода:")
+	fmt.Println("═══════════════════════════════════════════")
 	color.Unset()
-	color.Cyan("  --json       Вывод результата в формате JSON")
-	color.Cyan("  --csv        Вывод результата в формате CSV")
-	color.Cyan("  --table      Вывод результата в виде таблицы")
+}
+
+// outputJSON выводит результат в формате JSON
+func outputJSON(from, to string, amount, result, rate float64, rates *ExchangeRateResponse) {
+	printJSON(jsonResult(from, to, amount, result, rate, rates))
+}
+
+// jsonResult формирует JSON-представление результата конвертации
+func jsonResult(from, to string, amount, result, rate float64, rates *ExchangeRateResponse) JSONOutput {
+	return JSONOutput{
+		Success:        true,
+		Timestamp:      time.Now(),
+		FromCurrency:   from,
+		ToCurrency:     to,
+		Amount:         amount,
+		Result:         result,
+		ExchangeRate:   rate,
+		RateUpdateTime: time.Unix(rates.TimeLastUpdated, 0),
+		Provider:       rates.Provider,
+		Cached:         rates.Cached,
+	}
+}
+
+// printJSON выводит значение в виде JSON с отступами
+func printJSON(output any) {
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		outputError(fmt.Sprintf("ошибка формирования JSON: %v", err), true)
+		os.Exit(1)
+	}
+
+	fmt.Println(string(data))
+}
+
+// newUUID генерирует случайный UUID версии 4 (RFC 4122)
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// newReceipt создаёт квитанцию о конвертации с новым идентификатором
+func newReceipt(from, to string, amount, result, rate float64, rates *ExchangeRateResponse) Receipt {
+	return Receipt{
+		ID:        newUUID(),
+		Timestamp: time.Now(),
+		From:      from,
+		To:        to,
+		Amount:    amount,
+		Rate:      rate,
+		Result:    result,
+		Provider:  providerLabel(rates),
+	}
+}
+
+// renderReceipt формирует текст квитанции
+func renderReceipt(r Receipt, opts Options) string {
+	var b strings.Builder
+	b.WriteString("\n──────────── КВИТАНЦИЯ ────────────\n")
+	fmt.Fprintf(&b, "  Номер:     %s\n", r.ID)
+	fmt.Fprintf(&b, "  Дата:      %s\n", r.Timestamp.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, "  Сумма:     %s %s\n", formatNumber(r.Amount, 2, opts.Locale), r.From)
+	fmt.Fprintf(&b, "  Курс:      1 %s = %s %s\n", r.From, formatNumber(r.Rate, opts.PrecisionRate, opts.Locale), r.To)
+	fmt.Fprintf(&b, "  Результат: %s %s\n", formatNumber(r.Result, resultDecimals(r.To, opts.Whole), opts.Locale), r.To)
+	fmt.Fprintf(&b, "  Источник:  %s\n", r.Provider)
+	b.WriteString("───────────────────────────────────\n")
+	return b.String()
+}
+
+// outputCSV выводит результат в формате CSV
+func outputCSV(from, to string, amount, result, rate float64, _ time.Time) {
+	// timestamp,from,to,amount,result,rate
+	fmt.Printf("%s,%s,%s,%.2f,%.2f,%.6f\n",
+		time.Now().Format(time.RFC3339),
+		from,
+		to,
+		amount,
+		result,
+		rate,
+	)
+}
+
+// outputError выводит ошибку в формате JSON или CSV
+func outputError(message string, asJSON bool) {
+	if asJSON {
+		output := map[string]any{
+			"success": false,
+			"error":   message,
+		}
+		data, _ := json.MarshalIndent(output, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		// CSV формат ошибки
+		fmt.Printf("error,%s\n", message)
+	}
+}
+
+// loadBaseAmount возвращает базовую сумму: сохранённая через --set-base-amount
+// имеет приоритет над base_amount/base_currency из конфига
+func loadBaseAmount(cfg Config) (BaseAmount, bool) {
+	data, err := os.ReadFile(baseFile)
+	if err == nil {
+		var base BaseAmount
+		if json.Unmarshal(data, &base) == nil && base.Amount > 0 && base.Currency != "" {
+			return base, true
+		}
+	}
+	if cfg.BaseAmount > 0 && cfg.BaseCurrency != "" {
+		return BaseAmount{Amount: cfg.BaseAmount, Currency: cfg.BaseCurrency}, true
+	}
+	return BaseAmount{}, false
+}
+
+// saveBaseAmount сохраняет базовую сумму в файл
+func saveBaseAmount(base BaseAmount) error {
+	data, err := json.MarshalIndent(base, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(baseFile, data, 0644)
+}
+
+// formatPercent форматирует процент с точностью percentPrecision; signed — всегда со знаком
+func formatPercent(value float64, signed bool) string {
+	text := strconv.FormatFloat(value, 'f', percentPrecision, 64)
+	if signed && !strings.HasPrefix(text, "-") {
+		text = "+" + text
+	}
+	return text + "%"
+}
+
+// percentOf возвращает percent процентов от суммы
+func percentOf(amount, percent float64) float64 {
+	return amount * percent / 100
+}
+
+// alertKey ключ состояния оповещения для пары, направления и порога
+func alertKey(from, to, direction string, threshold float64) string {
+	return fmt.Sprintf("%s/%s %s %g", from, to, direction, threshold)
+}
+
+// alertFires решает, срабатывает ли оповещение: без repeat — только при переходе
+// через порог; состояние сбрасывается, когда курс возвращается обратно
+func alertFires(state map[string]bool, key string, crossed, repeat bool) bool {
+	wasActive := state[key]
+	if crossed {
+		state[key] = true
+	} else {
+		delete(state, key)
+	}
+	return crossed && (repeat || !wasActive)
+}
+
+// checkAlerts проверяет пороги --alert-above/--alert-below для курса пары
+// и возвращает сообщения сработавших оповещений
+func checkAlerts(state map[string]bool, from, to string, rate float64, opts Options) []string {
+	var messages []string
+	if opts.AlertAbove > 0 && alertFires(state, alertKey(from, to, "above", opts.AlertAbove), rate > opts.AlertAbove, opts.AlertRepeat) {
+		messages = append(messages, fmt.Sprintf("курс %s/%s поднялся выше %s: %s", from, to,
+			formatNumber(opts.AlertAbove, opts.PrecisionRate, opts.Locale), formatNumber(rate, opts.PrecisionRate, opts.Locale)))
+	}
+	if opts.AlertBelow > 0 && alertFires(state, alertKey(from, to, "below", opts.AlertBelow), rate < opts.AlertBelow, opts.AlertRepeat) {
+		messages = append(messages, fmt.Sprintf("курс %s/%s опустился ниже %s: %s", from, to,
+			formatNumber(opts.AlertBelow, opts.PrecisionRate, opts.Locale), formatNumber(rate, opts.PrecisionRate, opts.Locale)))
+	}
+	return messages
+}
+
+// loadAlertState загружает состояние оповещений из файла
+func loadAlertState() map[string]bool {
+	state := make(map[string]bool)
+	data, err := os.ReadFile(alertsFile)
+	if err != nil {
+		return state
+	}
+	json.Unmarshal(data, &state)
+	return state
+}
+
+// saveAlertState сохраняет состояние оповещений в файл
+func saveAlertState(state map[string]bool) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	os.WriteFile(alertsFile, data, 0644)
+}
+
+// loadSnapshots загружает снимки курсов, сгруппированные по базовой валюте
+func loadSnapshots() map[string][]Snapshot {
+	snapshots := make(map[string][]Snapshot)
+	data, err := os.ReadFile(snapsFile)
+	if err != nil {
+		return snapshots
+	}
+	json.Unmarshal(data, &snapshots)
+	return snapshots
+}
+
+// saveSnapshots сохраняет снимки курсов в файл
+func saveSnapshots(snapshots map[string][]Snapshot) {
+	data, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return
+	}
+	os.WriteFile(snapsFile, data, 0644)
+}
+
+// recordSnapshot добавляет снимок курсов; для одной даты хранится только
+// последний снимок, снимки упорядочены по дате
+func recordSnapshot(snapshots map[string][]Snapshot, base string, rates *ExchangeRateResponse, fetchedAt time.Time) {
+	date := rates.Date
+	if date == "" {
+		date = fetchedAt.Format("2006-01-02")
+	}
+	snap := Snapshot{Date: date, FetchedAt: fetchedAt, Rates: rates.Rates}
+
+	list := snapshots[base]
+	for i := range list {
+		if list[i].Date == date {
+			list[i] = snap
+			return
+		}
+	}
+	list = append(list, snap)
+	sort.Slice(list, func(i, j int) bool { return list[i].Date < list[j].Date })
+	snapshots[base] = list
+}
+
+// snapshotsSince возвращает снимки с датой не раньше since
+func snapshotsSince(snaps []Snapshot, since time.Time) []Snapshot {
+	from := since.Format("2006-01-02")
+	var result []Snapshot
+	for _, snap := range snaps {
+		if snap.Date >= from {
+			result = append(result, snap)
+		}
+	}
+	return result
+}
+
+// topMovers сравнивает самый старый и самый новый снимки в окне и
+// сортирует валюты по модулю изменения курса; валюты, отсутствующие
+// в одном из снимков, пропускаются
+func topMovers(snaps []Snapshot, since time.Time) ([]Mover, Snapshot, Snapshot, error) {
+	window := snapshotsSince(snaps, since)
+	if len(window) < 2 {
+		return nil, Snapshot{}, Snapshot{}, fmt.Errorf("недостаточно снимков курсов за период (нужно минимум 2, есть %d)", len(window))
+	}
+	oldest, newest := window[0], window[len(window)-1]
+
+	var movers []Mover
+	for code, newRate := range newest.Rates {
+		oldRate, ok := oldest.Rates[code]
+		if !ok || oldRate == 0 {
+			continue
+		}
+		movers = append(movers, Mover{
+			Currency: code,
+			OldRate:  oldRate,
+			NewRate:  newRate,
+			Change:   (newRate - oldRate) / oldRate * 100,
+		})
+	}
+	sort.Slice(movers, func(i, j int) bool {
+		ai, aj := math.Abs(movers[i].Change), math.Abs(movers[j].Change)
+		if ai != aj {
+			return ai > aj
+		}
+		return movers[i].Currency < movers[j].Currency
+	})
+	return movers, oldest, newest, nil
+}
+
+// smoothRate считает медиану или среднее курса валюты по снимкам окна;
+// ok=false, если снимков с этой валютой меньше двух
+func smoothRate(window []Snapshot, code, method string) (float64, bool) {
+	var values []float64
+	for _, snap := range window {
+		if rate, found := snap.Rates[code]; found {
+			values = append(values, rate)
+		}
+	}
+	if len(values) < 2 {
+		return 0, false
+	}
+	if method == "mean" {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), true
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2, true
+	}
+	return values[mid], true
+}
+
+// smoothRates возвращает копию курсов, где курсы целевых валют заменены
+// сглаженными; валюты без достаточной истории остаются со спотовым курсом
+// и перечисляются в fallback
+func smoothRates(rates *ExchangeRateResponse, window []Snapshot, targets []string, method string) (*ExchangeRateResponse, int, []string) {
+	smoothed := *rates
+	smoothed.Rates = make(map[string]float64, len(rates.Rates))
+	for code, rate := range rates.Rates {
+		smoothed.Rates[code] = rate
+	}
+	var fallback []string
+	for _, code := range targets {
+		if _, ok := rates.Rates[code]; !ok {
+			continue
+		}
+		if rate, ok := smoothRate(window, code, method); ok {
+			smoothed.Rates[code] = rate
+		} else {
+			fallback = append(fallback, code)
+		}
+	}
+	return &smoothed, len(window), fallback
+}
+
+// smoothMethodName возвращает название способа сглаживания для вывода
+func smoothMethodName(method string) string {
+	if method == "mean" {
+		return "среднее"
+	}
+	return "медиана"
+}
+
+// snapshotOn возвращает последний снимок с датой не позже date
+func snapshotOn(snaps []Snapshot, date string) (Snapshot, bool) {
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if snaps[i].Date <= date {
+			return snaps[i], true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// thenVsNow формирует строки «тогда и сейчас» для --then: конвертация по курсу
+// из снимка на дату (или ближайшего более раннего) и по текущему курсу с
+// изменением в процентах; без снимка — только текущая строка с пояснением
+func thenVsNow(amount float64, from, to string, rate float64, nowDate string, snaps []Snapshot, opts Options) []string {
+	decimals := resultDecimals(to, opts.Whole)
+	line := func(date string, r float64) string {
+		return fmt.Sprintf("%s: %s %s = %s %s (курс %s)", date, formatNumber(amount, 2, opts.Locale), from,
+			formatNumber(amount*r, decimals, opts.Locale), to, formatNumber(r, opts.PrecisionRate, opts.Locale))
+	}
+	now := line(nowDate, rate)
+
+	snap, ok := snapshotOn(snaps, opts.Then)
+	thenRate := snap.Rates[to]
+	if !ok || thenRate == 0 {
+		return []string{now, fmt.Sprintf("ℹ️  Провайдер не отдаёт исторические курсы, а локального снимка %s/%s на %s нет — показан только текущий курс", from, to, opts.Then)}
+	}
+	label := snap.Date
+	if snap.Date != opts.Then {
+		label = fmt.Sprintf("%s (ближайший снимок к %s)", snap.Date, opts.Then)
+	}
+	change := (rate - thenRate) / thenRate * 100
+	return []string{line(label, thenRate), now, "Изменение: " + formatPercent(change, true)}
+}
+
+// DateComparison изменение курса пары между двумя снимками (--compare-dates)
+type DateComparison struct {
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	Date1      string  `json:"date1"` // дата снимка, может быть раньше запрошенной
+	Date2      string  `json:"date2"`
+	Rate1      float64 `json:"rate1"`
+	Rate2      float64 `json:"rate2"`
+	Days       int     `json:"days"`
+	Change     float64 `json:"change_percent"`
+	Annualized float64 `json:"annualized_percent"`
+}
+
+// compareDates сравнивает курс пары в снимках на две даты (ближайших не позже
+// каждой); порядок дат не важен, раньше всегда идёт более ранний снимок
+func compareDates(snaps []Snapshot, from, to, date1, date2 string) (DateComparison, error) {
+	if date1 > date2 {
+		date1, date2 = date2, date1
+	}
+	cmp := DateComparison{From: from, To: to}
+	var snap1, snap2 Snapshot
+	for _, s := range []struct {
+		date string
+		snap *Snapshot
+	}{{date1, &snap1}, {date2, &snap2}} {
+		snap, ok := snapshotOn(snaps, s.date)
+		if !ok || snap.Rates[to] == 0 {
+			return cmp, fmt.Errorf("нет локального снимка %s/%s на %s или раньше — провайдер не отдаёт исторические курсы", from, to, s.date)
+		}
+		*s.snap = snap
+	}
+	if snap1.Date == snap2.Date {
+		return cmp, fmt.Errorf("для %s и %s найден один и тот же снимок %s — сравнивать нечего", date1, date2, snap1.Date)
+	}
+	t1, _ := time.Parse("2006-01-02", snap1.Date)
+	t2, _ := time.Parse("2006-01-02", snap2.Date)
+	cmp.Date1, cmp.Date2 = snap1.Date, snap2.Date
+	cmp.Rate1, cmp.Rate2 = snap1.Rates[to], snap2.Rates[to]
+	cmp.Days = int(t2.Sub(t1).Hours() / 24)
+	cmp.Change = (cmp.Rate2 - cmp.Rate1) / cmp.Rate1 * 100
+	cmp.Annualized = annualizedChange(cmp.Rate1, cmp.Rate2, cmp.Days)
+	return cmp, nil
+}
+
+// annualizedChange годовой темп изменения в процентах при сложном начислении:
+// (r2/r1)^(365/days) − 1; для периода меньше года это экстраполяция, больше — среднегодовой темп
+func annualizedChange(r1, r2 float64, days int) float64 {
+	return (math.Pow(r2/r1, 365/float64(days)) - 1) * 100
+}
+
+// Lines строки вывода --compare-dates
+func (c DateComparison) Lines(opts Options) []string {
+	rate := func(date string, r float64) string {
+		return fmt.Sprintf("%s: 1 %s = %s %s", date, c.From, formatNumber(r, opts.PrecisionRate, opts.Locale), c.To)
+	}
+	period := "экстраполяция периода меньше года"
+	if c.Days >= 365 {
+		period = "среднегодовой темп"
+	}
+	return []string{
+		rate(c.Date1, c.Rate1),
+		rate(c.Date2, c.Rate2),
+		fmt.Sprintf("Изменение: %s за %d дн.", formatPercent(c.Change, true), c.Days),
+		fmt.Sprintf("В пересчёте на год: %s (%s)", formatPercent(c.Annualized, true), period),
+	}
+}
+
+// referenceSnapshot возвращает последний снимок с датой раньше текущих курсов
+func referenceSnapshot(snaps []Snapshot, current *ExchangeRateResponse) (Snapshot, bool) {
+	date := current.Date
+	if date == "" {
+		date = time.Unix(current.TimeLastUpdated, 0).Format("2006-01-02")
+	}
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if snaps[i].Date < date {
+			return snaps[i], true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// changedSinceSnapshot отбирает валюты, курс которых отличается от снимка хотя бы на
+// minChange процентов; валюты, которых в снимке нет, считаются изменившимися
+func changedSinceSnapshot(codes []string, rates map[string]float64, reference Snapshot, minChange float64) []string {
+	var changed []string
+	for _, code := range codes {
+		previous, ok := reference.Rates[code]
+		if ok && previous > 0 {
+			change := math.Abs(rates[code]-previous) / previous * 100
+			if rates[code] == previous || change < minChange {
+				continue
+			}
+		}
+		changed = append(changed, code)
+	}
+	return changed
+}
+
+// filterChanged применяет --changed-only к списку валют и возвращает прошлые курсы из снимка;
+// без снимка возвращается весь список с пояснением
+func filterChanged(codes []string, base string, rates *ExchangeRateResponse, minChange float64, quiet bool) ([]string, map[string]float64) {
+	reference, ok := referenceSnapshot(loadSnapshots()[base], rates)
+	if !ok {
+		if !quiet {
+			color.HiBlack("ℹ️  --changed-only: нет предыдущего снимка курсов %s, показаны все валюты", base)
+		}
+		return codes, nil
+	}
+	changed := changedSinceSnapshot(codes, rates.Rates, reference, minChange)
+	if !quiet {
+		color.HiBlack("ℹ️  Изменились со снимка %s: %d из %d валют", reference.Date, len(changed), len(codes))
+	}
+	previous := make(map[string]float64, len(changed))
+	for _, code := range changed {
+		previous[code] = reference.Rates[code]
+	}
+	return changed, previous
+}
+
+// snapshotChangeMessage описывает изменение курса валюты относительно снимка; курсы форматируются по локали
+func snapshotChangeMessage(code string, rate, previous float64, locale string) string {
+	if previous <= 0 {
+		return fmt.Sprintf("%s: новая валюта, в снимке курса не было", code)
+	}
+	return fmt.Sprintf("%s: %s → %s (%s)", code, formatNumber(previous, 4, locale), formatNumber(rate, 4, locale), formatPercent((rate-previous)/previous*100, true))
+}
+
+// movementColor цвет строки курса: зелёный — курс вырос относительно снимка,
+// красный — упал, обычный — не изменился или в снимке нет курса
+func movementColor(rate, previous float64) color.Attribute {
+	switch {
+	case previous <= 0 || rate == previous:
+		return color.FgCyan
+	case rate > previous:
+		return color.FgGreen
+	}
+	return color.FgRed
+}
+
+// ratesPassVerify проверяет всю таблицу курсов по последнему снимку за прошлую
+// дату; без снимка таблица считается прошедшей проверку
+func ratesPassVerify(snaps []Snapshot, rates *ExchangeRateResponse, factor float64) bool {
+	reference, ok := referenceSnapshot(snaps, rates)
+	if !ok {
+		return true
+	}
+	return len(findAnomalies(rates.Rates, reference.Rates, sortedCurrencies(rates), factor)) == 0
+}
+
+// findAnomalies возвращает валюты, чей курс отличается от снимка больше
+// чем в factor раз (в любую сторону); валюты без курса в снимке пропускаются
+func findAnomalies(current, reference map[string]float64, codes []string, factor float64) []Mover {
+	var anomalies []Mover
+	for _, code := range codes {
+		newRate, ok1 := current[code]
+		oldRate, ok2 := reference[code]
+		if !ok1 || !ok2 || oldRate <= 0 {
+			continue
+		}
+		if newRate <= 0 || newRate/oldRate > factor || oldRate/newRate > factor {
+			anomalies = append(anomalies, Mover{
+				Currency: code,
+				OldRate:  oldRate,
+				NewRate:  newRate,
+				Change:   (newRate - oldRate) / oldRate * 100,
+			})
+		}
+	}
+	return anomalies
+}
+
+// printTopMovers выводит таблицу валют с наибольшим изменением курса
+func printTopMovers(base string, movers []Mover, oldest, newest Snapshot, locale string) {
 	fmt.Println()
 	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("Прочие флаги:")
+	fmt.Printf("  Изменение курсов к %s: %s → %s\n", base, oldest.Date, newest.Date)
+	fmt.Println("  ┌──────────┬──────────────┬──────────────┬────────────┐")
+	fmt.Println("  │ Валюта   │ Было         │ Стало        │ Изменение  │")
+	fmt.Println("  ├──────────┼──────────────┼──────────────┼────────────┤")
 	color.Unset()
-	color.Cyan("  --offline    Использовать сохранённые курсы без запроса к API")
-	color.Cyan("  --history          Показать историю всех конвертаций")
-	color.Cyan("  --history USD/RUB  Показать историю по конкретной паре")
-	color.Cyan("  --help, -h   Показать эту справку")
-	fmt.Println()
+	for _, m := range movers {
+		line := fmt.Sprintf("  │ %-8s │ %-12s │ %-12s │ %s │", m.Currency,
+			formatNumber(m.OldRate, 4, locale), formatNumber(m.NewRate, 4, locale), padLeft(formatPercent(m.Change, true), 10))
+		if m.Change > 0 {
+			color.Green("%s", line)
+		} else if m.Change < 0 {
+			color.Red("%s", line)
+		} else {
+			fmt.Println(line)
+		}
+	}
 	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("Примеры:")
+	fmt.Println("  └──────────┴──────────────┴──────────────┴────────────┘")
 	color.Unset()
-	fmt.Println("  go run main.go USD RUB 100")
-	fmt.Println("  go run main.go --table USD RUB,EUR,CNY 100")
-	fmt.Println("  go run main.go --json USD EUR 50")
-	fmt.Println("  go run main.go --offline USD RUB 100")
-	fmt.Println("  go run main.go --history USD/RUB")
 	fmt.Println()
 }
 
-// printHeader выводит заголовок программы
-func printHeader() {
-	color.Set(color.FgGreen, color.Bold)
-	fmt.Println("╔════════════════════════════════════════╗")
-	fmt.Println("║     КОНВЕРТЕР ВАЛЮТ (Go Version)       ║")
-	fmt.Println("╚════════════════════════════════════════╝")
-	color.Unset()
-	fmt.Println()
+// parseBatch разбирает CSV пакетной конвертации amount,from,to;
+// строка заголовка и пустые строки пропускаются, номера строк соответствуют файлу,
+// коды валют проверяются при конвертации
+func parseBatch(data []byte) ([]BatchRow, error) {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+
+	var rows []BatchRow
+	for first := true; ; first = false {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ошибка разбора файла: %w", err)
+		}
+		line, _ := r.FieldPos(0)
+		if first && strings.EqualFold(strings.TrimSpace(rec[0]), "amount") {
+			continue
+		}
+		if len(rec) != 3 {
+			return nil, fmt.Errorf("строка %d: ожидается 3 поля (amount, from, to), получено %d", line, len(rec))
+		}
+		amount, err := strconv.ParseFloat(strings.TrimSpace(rec[0]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: неверная сумма %q", line, rec[0])
+		}
+		rows = append(rows, BatchRow{Line: line, Amount: amount, From: rec[1], To: rec[2]})
+	}
+	return rows, nil
+}
+
+// dedupeBatch схлопывает одинаковые строки amount,from,to (без учёта регистра и
+// пробелов в кодах), оставляя первое вхождение и число повторов в Count
+func dedupeBatch(rows []BatchRow) []BatchRow {
+	index := make(map[string]int)
+	var unique []BatchRow
+	for _, row := range rows {
+		key := strconv.FormatFloat(row.Amount, 'f', -1, 64) + "," +
+			strings.ToUpper(strings.TrimSpace(row.From)) + "," + strings.ToUpper(strings.TrimSpace(row.To))
+		if i, ok := index[key]; ok {
+			unique[i].Count++
+			continue
+		}
+		row.Count = 1
+		index[key] = len(unique)
+		unique = append(unique, row)
+	}
+	return unique
+}
+
+// runBatch конвертирует строки пакета; таблица курсов загружается один раз на базовую
+// валюту, справочные данные берутся через meta (nil — без кэширования), готовые
+// строки отмечаются в progress (nil — без индикатора); при failFast прогон
+// останавливается после первой строки с ошибкой, а после отмены ctx новые строки не начинаются
+func runBatch(ctx context.Context, rows []BatchRow, fetch func(base string) (*ExchangeRateResponse, error), meta *currencyMetaCache, progress *progressBar, failFast bool) []BatchResult {
+	tables := make(map[string]*ExchangeRateResponse)
+	failed := make(map[string]error)
+
+	// convert возвращает false, если строка не выполнена из-за отмены ctx
+	convert := func(row BatchRow) (BatchResult, bool) {
+		res := BatchResult{Line: row.Line, Amount: row.Amount, From: row.From, To: row.To, Count: row.Count}
+		from, err := meta.lookup(row.From)
+		if err == nil {
+			res.From = from.Code
+			res.Target, err = meta.lookup(row.To)
+			res.To = res.Target.Code
+		}
+		if err != nil {
+			res.Error = err.Error()
+			return res, true
+		}
+
+		rates, ok := tables[from.Code]
+		if !ok {
+			if err, seen := failed[from.Code]; seen {
+				res.Error = err.Error()
+				return res, true
+			}
+			if rates, err = fetch(from.Code); err != nil {
+				// Запрос отменён по истечении бюджета — строка не выполнена, а пропущена
+				if ctx.Err() != nil {
+					return BatchResult{}, false
+				}
+				failed[from.Code] = err
+				res.Error = err.Error()
+				return res, true
+			}
+			tables[from.Code] = rates
+		}
+
+		res.Result, err = convertCurrency(row.Amount, from.Code, res.To, rates)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Rate = rates.Rates[res.To]
+		}
+		return res, true
+	}
+
+	results := make([]BatchResult, 0, len(rows))
+	for _, row := range rows {
+		// После исчерпания --timeout-budget новые строки не начинаются
+		if ctx.Err() != nil {
+			break
+		}
+		res, done := convert(row)
+		if !done {
+			break
+		}
+		results = append(results, res)
+		progress.Add(1)
+		if failFast && res.Error != "" {
+			break
+		}
+	}
+	progress.Clear()
+	return results
 }
 
-// getInput получает ввод от пользователя
-func getInput(prompt string) string {
-	fmt.Print(prompt)
-	var input string
-	fmt.Scanln(&input)
-	return strings.ToUpper(strings.TrimSpace(input))
+// ratesHolder хранит таблицу курсов для долгого --stream и обновляет её в фоне
+type ratesHolder struct {
+	mu    sync.RWMutex
+	rates *ExchangeRateResponse
+	fetch func() (*ExchangeRateResponse, error)
 }
 
-// getAmount получает сумму от пользователя
-func getAmount(prompt string) float64 {
-	fmt.Print(prompt)
-	var input string
-	fmt.Scanln(&input)
-	amount, err := strconv.ParseFloat(input, 64)
+// newRatesHolder загружает курсы один раз; ошибка первой загрузки возвращается
+func newRatesHolder(fetch func() (*ExchangeRateResponse, error)) (*ratesHolder, error) {
+	rates, err := fetch()
 	if err != nil {
-		color.Red("❌ Ошибка: неверная сумма")
-		os.Exit(1)
+		return nil, err
 	}
-	return amount
+	return &ratesHolder{rates: rates, fetch: fetch}, nil
 }
 
-// loadCache загружает кэш курсов из файла
-func loadCache() map[string]CacheEntry {
-	cache := make(map[string]CacheEntry)
-	data, err := os.ReadFile(cacheFile)
-	if err != nil {
-		return cache
-	}
-	json.Unmarshal(data, &cache)
-	return cache
+// Get возвращает текущую таблицу курсов
+func (h *ratesHolder) Get() *ExchangeRateResponse {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.rates
 }
 
-// saveCache сохраняет кэш курсов в файл
-func saveCache(cache map[string]CacheEntry) {
-	data, err := json.MarshalIndent(cache, "", "  ")
+// Refresh перезагружает курсы; при ошибке остаётся прежняя таблица
+func (h *ratesHolder) Refresh() error {
+	rates, err := h.fetch()
 	if err != nil {
-		return
+		return err
 	}
-	os.WriteFile(cacheFile, data, 0644)
+	h.mu.Lock()
+	h.rates = rates
+	h.mu.Unlock()
+	return nil
 }
 
-// getExchangeRates получает курсы валют из кэша или API
-func getExchangeRates(baseCurrency string, silent bool, offline bool) (*ExchangeRateResponse, error) {
-	cache := loadCache()
-	if entry, ok := cache[baseCurrency]; ok {
-		if offline || time.Since(entry.FetchedAt) < cacheTTL {
-			if !silent {
-				if offline {
-					color.HiBlack("📴 Оффлайн режим: используются сохранённые курсы от %s",
-						entry.FetchedAt.Format("2006-01-02 15:04"))
-				} else {
-					color.HiBlack("💾 Используются кэшированные курсы (обновление через %d мин.)",
-						int(cacheTTL.Minutes())-int(time.Since(entry.FetchedAt).Minutes()))
-				}
+// RefreshEvery обновляет курсы каждые interval до отмены ctx; ошибки передаются в onError
+func (h *ratesHolder) RefreshEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.Refresh(); err != nil {
+				onError(err)
 			}
-			return &entry.Data, nil
 		}
 	}
+}
 
-	if offline {
-		return nil, fmt.Errorf("нет сохранённых курсов для %s — выполните конвертацию онлайн хотя бы раз", baseCurrency)
+// streamConvert читает суммы по одной на строку и сразу пишет результат по курсу
+// из current; пустые строки пропускаются, неверные суммы сообщаются в errOut
+func streamConvert(in io.Reader, out, errOut io.Writer, from, to string, current func() *ExchangeRateResponse, decimals int) (converted, failed int) {
+	scanner := bufio.NewScanner(in)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		amount, err := strconv.ParseFloat(strings.Replace(text, ",", ".", 1), 64)
+		if err != nil {
+			fmt.Fprintf(errOut, "строка %d: неверная сумма %q\n", line, text)
+			failed++
+			continue
+		}
+		result, err := convertCurrency(amount, from, to, current())
+		if err != nil {
+			fmt.Fprintf(errOut, "строка %d: %v\n", line, err)
+			failed++
+			continue
+		}
+		fmt.Fprintln(out, tableNumber(result, decimals))
+		converted++
 	}
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(errOut, "ошибка чтения stdin: %v\n", err)
+		failed++
 	}
+	return converted, failed
+}
 
-	resp, err := client.Get(apiURL + baseCurrency)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка при запросе к API: %w", err)
+// progressBar индикатор выполнения для длинных прогонов; счётчик атомарный,
+// поэтому Add можно вызывать из нескольких горутин
+type progressBar struct {
+	total   int
+	done    atomic.Int64
+	out     io.Writer
+	mu      sync.Mutex
+	lastPct int
+}
+
+// newProgressBar создаёт индикатор; nil, если выводить его некуда (не терминал,
+// машинный формат или пустой прогон)
+func newProgressBar(total int, out io.Writer, enabled bool) *progressBar {
+	if !enabled || total <= 0 {
+		return nil
 	}
-	defer resp.Body.Close()
+	return &progressBar{total: total, out: out, lastPct: -1}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API вернул код ошибки: %d", resp.StatusCode)
+// Add отмечает n готовых строк и перерисовывает индикатор при смене процента
+func (p *progressBar) Add(n int) {
+	if p == nil {
+		return
+	}
+	done := int(p.done.Add(int64(n)))
+	pct := done * 100 / p.total
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pct == p.lastPct {
+		return
 	}
+	p.lastPct = pct
+	fmt.Fprint(p.out, "\r"+renderProgress(done, p.total, 30))
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+// Clear стирает индикатор перед выводом итогов
+func (p *progressBar) Clear() {
+	if p == nil {
+		return
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.out, "\r"+strings.Repeat(" ", 30+len(strconv.Itoa(p.total))*2+12)+"\r")
+}
 
-	var rates ExchangeRateResponse
-	err = json.Unmarshal(body, &rates)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка парсинга JSON: %w", err)
+// renderProgress рисует строку индикатора: [#####.....]  50% 5/10
+func renderProgress(done, total, width int) string {
+	done = min(done, total)
+	filled := done * width / total
+	return fmt.Sprintf("[%s%s] %3d%% %d/%d", strings.Repeat("#", filled), strings.Repeat(".", width-filled),
+		done*100/total, done, total)
+}
+
+// writeBatchCSV выводит результаты пакета в CSV: line,from,to,amount,result,rate,error
+// и, с withCount, столбец count с числом схлопнутых строк
+func writeBatchCSV(out io.Writer, results []BatchResult, withCount bool) {
+	w := csv.NewWriter(out)
+	for _, r := range results {
+		record := []string{
+			strconv.Itoa(r.Line), r.From, r.To,
+			strconv.FormatFloat(r.Amount, 'f', 2, 64),
+			strconv.FormatFloat(r.Result, 'f', r.Target.MinorUnits, 64),
+			strconv.FormatFloat(r.Rate, 'f', 6, 64),
+			r.Error,
+		}
+		if withCount {
+			record = append(record, strconv.Itoa(r.Count))
+		}
+		w.Write(record)
 	}
+	w.Flush()
+}
 
-	// Сохраняем в кэш
-	cache[baseCurrency] = CacheEntry{FetchedAt: time.Now(), Data: rates}
-	saveCache(cache)
+// batchLines формирует строки результатов пакета; с opts.Align номера, суммы
+// и результаты выравниваются по самой широкой строке
+func batchLines(results []BatchResult, opts Options) []string {
+	type cells struct{ line, amount, from, result, to, repeat string }
+	rows := make([]cells, len(results))
+	var wLine, wAmount, wFrom, wResult int
+	for i, r := range results {
+		c := cells{line: strconv.Itoa(r.Line), from: r.From, to: r.To}
+		if r.Error == "" {
+			decimals := r.Target.MinorUnits
+			if containsString(opts.Whole, r.To) {
+				decimals = 0
+			}
+			c.amount = formatNumber(r.Amount, 2, opts.Locale)
+			c.result = formatNumber(r.Result, decimals, opts.Locale)
+			if r.Count > 1 {
+				c.repeat = fmt.Sprintf(" (×%d)", r.Count)
+			}
+		}
+		if opts.Align {
+			wLine = max(wLine, utf8.RuneCountInString(c.line))
+			wAmount = max(wAmount, utf8.RuneCountInString(c.amount))
+			wFrom = max(wFrom, utf8.RuneCountInString(c.from))
+			wResult = max(wResult, utf8.RuneCountInString(c.result))
+		}
+		rows[i] = c
+	}
 
-	return &rates, nil
+	lines := make([]string, len(results))
+	for i, r := range results {
+		c := rows[i]
+		if r.Error != "" {
+			lines[i] = fmt.Sprintf("  строка %s: ❌ %s", padLeft(c.line, wLine), r.Error)
+			continue
+		}
+		lines[i] = fmt.Sprintf("  строка %s: %s %s = %s %s%s", padLeft(c.line, wLine), padLeft(c.amount, wAmount),
+			padRight(c.from, wFrom), padLeft(c.result, wResult), c.to, c.repeat)
+	}
+	return lines
 }
 
-// convertCurrency конвертирует валюту
-func convertCurrency(amount float64, _ string, to string, rates *ExchangeRateResponse) (float64, error) {
-	if rate, ok := rates.Rates[to]; ok {
-		return amount * rate, nil
+// printBatch выводит результаты пакетной конвертации; сумма результата
+// округляется по числу знаков целевой валюты
+func printBatch(results []BatchResult, opts Options) {
+	fmt.Println()
+	failed := 0
+	lines := batchLines(results, opts)
+	for i, r := range results {
+		if r.Error != "" {
+			failed++
+			color.Red("%s", lines[i])
+			continue
+		}
+		color.Green("%s", lines[i])
 	}
-	return 0, fmt.Errorf("валюта %s не найдена", to)
+	fmt.Println()
+	color.HiBlack("  Строк: %d, успешно: %d, с ошибкой: %d", len(results), len(results)-failed, failed)
 }
 
-// formatTimeAgo форматирует время, прошедшее с момента обновления
-func formatTimeAgo(duration time.Duration) string {
-	hours := int(duration.Hours())
-	minutes := int(duration.Minutes()) % 60
+// isHoldingsFormat проверяет формат файла портфеля
+func isHoldingsFormat(format string) bool {
+	return format == "csv" || format == "tsv" || format == "json"
+}
 
-	if hours > 24 {
-		days := hours / 24
-		if days == 1 {
-			return "1 день назад"
+// detectHoldingsFormat определяет формат файла портфеля по расширению
+func detectHoldingsFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv", nil
+	case ".tsv", ".tab":
+		return "tsv", nil
+	case ".json":
+		return "json", nil
+	}
+	return "", fmt.Errorf("не удалось определить формат %s по расширению — укажите --holdings-format", path)
+}
+
+// loadHoldings читает позиции портфеля из файла в формате CSV, TSV или JSON
+func loadHoldings(path, format string) ([]Holding, error) {
+	if format == "" {
+		var err error
+		if format, err = detectHoldingsFormat(path); err != nil {
+			return nil, err
 		}
-		return fmt.Sprintf("%d дня/дней назад", days)
 	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "json":
+		return parseHoldingsJSON(data)
+	case "tsv":
+		return parseHoldingsDelimited(data, '\t')
+	default:
+		return parseHoldingsDelimited(data, ',')
+	}
+}
 
-	if hours > 0 {
-		if hours == 1 {
-			return "1 час назад"
+// parseHoldingsDelimited разбирает позиции в формате currency<sep>amount;
+// строка заголовка (currency,amount) пропускается
+func parseHoldingsDelimited(data []byte, sep rune) ([]Holding, error) {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.Comma = sep
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка разбора файла: %w", err)
+	}
+
+	var holdings []Holding
+	for i, rec := range records {
+		if len(rec) == 1 && strings.TrimSpace(rec[0]) == "" {
+			continue
 		}
-		if hours < 5 {
-			return fmt.Sprintf("%d часа назад", hours)
+		if i == 0 && len(rec) >= 1 && strings.EqualFold(strings.TrimSpace(rec[0]), "currency") {
+			continue
 		}
-		return fmt.Sprintf("%d часов назад", hours)
+		if len(rec) != 2 {
+			return nil, fmt.Errorf("строка %d: ожидается 2 поля (currency, amount), получено %d", i+1, len(rec))
+		}
+		amount, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: неверная сумма %q", i+1, rec[1])
+		}
+		h := Holding{Currency: strings.ToUpper(strings.TrimSpace(rec[0])), Amount: amount}
+		if err := validateHolding(h); err != nil {
+			return nil, fmt.Errorf("строка %d: %w", i+1, err)
+		}
+		holdings = append(holdings, h)
 	}
+	return holdings, nil
+}
 
-	if minutes > 0 {
-		if minutes == 1 {
-			return "1 минуту назад"
-		}
-		if minutes < 5 {
-			return fmt.Sprintf("%d минуты назад", minutes)
+// parseHoldingsJSON разбирает позиции в формате [{"currency":"USD","amount":100}]
+func parseHoldingsJSON(data []byte) ([]Holding, error) {
+	var holdings []Holding
+	if err := json.Unmarshal(data, &holdings); err != nil {
+		return nil, fmt.Errorf("ошибка парсинга JSON: %w", err)
+	}
+	for i := range holdings {
+		holdings[i].Currency = strings.ToUpper(strings.TrimSpace(holdings[i].Currency))
+		if err := validateHolding(holdings[i]); err != nil {
+			return nil, fmt.Errorf("элемент %d: %w", i+1, err)
 		}
-		return fmt.Sprintf("%d минут назад", minutes)
 	}
+	return holdings, nil
+}
 
-	return "только что"
+// validateHolding проверяет позицию портфеля
+func validateHolding(h Holding) error {
+	if !isCurrencyCode(h.Currency) {
+		return fmt.Errorf("неверный код валюты %q", h.Currency)
+	}
+	if h.Amount < 0 {
+		return fmt.Errorf("отрицательная сумма %.2f", h.Amount)
+	}
+	return nil
+}
+
+// valueHoldings пересчитывает позиции в базовую валюту таблицы курсов
+func valueHoldings(holdings []Holding, rates *ExchangeRateResponse, progress *progressBar) ([]HoldingValue, float64, error) {
+	defer progress.Clear()
+	var values []HoldingValue
+	total := 0.0
+	for _, h := range holdings {
+		progress.Add(1)
+		r, ok := rates.Rates[h.Currency]
+		if !ok || r == 0 {
+			return nil, 0, fmt.Errorf("валюта %s не найдена", h.Currency)
+		}
+		v := HoldingValue{Holding: h, Value: h.Amount / r, Rate: 1 / r}
+		values = append(values, v)
+		total += v.Value
+	}
+	return values, total, nil
 }
 
-// printTable выводит результаты конвертации в виде таблицы
-func printTable(amount float64, from string, rows []TableRow, rates *ExchangeRateResponse) {
+// printPortfolio выводит таблицу стоимости портфеля; числа форматируются по локали
+func printPortfolio(target string, values []HoldingValue, total float64, rates *ExchangeRateResponse, locale string) {
 	fmt.Println()
 	color.Set(color.FgYellow, color.Bold)
-	fmt.Printf("  Конвертация %.2f %s\n", amount, from)
-	fmt.Println("  ┌──────────┬────────────────┬──────────────┐")
-	fmt.Println("  │ Валюта   │ Результат      │ Курс         │")
-	fmt.Println("  ├──────────┼────────────────┼──────────────┤")
+	fmt.Printf("  Портфель в %s\n", target)
+	fmt.Println("  ┌──────────┬────────────────┬────────────────┬──────────────┐")
+	fmt.Println("  │ Валюта   │ Сумма          │ Стоимость      │ Курс         │")
+	fmt.Println("  ├──────────┼────────────────┼────────────────┼──────────────┤")
 	color.Unset()
-	for _, row := range rows {
-		color.Green("  │ %-8s │ %-14.2f │ %-12.4f │", row.Currency, row.Result, row.Rate)
+	for _, v := range values {
+		color.Green("  │ %-8s │ %-14s │ %-14s │ %-12s │", v.Currency,
+			formatNumber(v.Amount, 2, locale), formatNumber(v.Value, 2, locale), formatNumber(v.Rate, 4, locale))
 	}
 	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("  └──────────┴────────────────┴──────────────┘")
+	fmt.Println("  └──────────┴────────────────┴────────────────┴──────────────┘")
+	fmt.Printf("  Итого: %s %s\n", formatNumber(total, 2, locale), target)
 	color.Unset()
 
 	updateTime := time.Unix(rates.TimeLastUpdated, 0)
-	timeAgo := formatTimeAgo(time.Since(updateTime))
 	fmt.Println()
-	color.HiBlack("  Последнее обновление: %s (%s)", updateTime.Format("2006-01-02 15:04:05"), timeAgo)
+	color.HiBlack("  Последнее обновление: %s (%s)", updateTime.Format("2006-01-02 15:04:05"), formatTimeAgo(time.Since(updateTime)))
 	fmt.Println()
 }
 
-// printResult выводит результат конвертации
-func printResult(amount float64, from string, result float64, to string, rates *ExchangeRateResponse) {
-	fmt.Println()
-	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("════════════════ РЕЗУЛЬТАТ ════════════════")
-	color.Unset()
+// loadHistory читает историю конвертаций из файла (пустая история при ошибке)
+func loadHistory() []ConversionRecord {
+	var history []ConversionRecord
+	data, err := os.ReadFile(historyFile)
+	if err == nil {
+		json.Unmarshal(data, &history)
+	}
+	return history
+}
 
-	color.Green("%.2f %s = %.2f %s", amount, from, result, to)
+// lastRecordForPair возвращает последнюю запись истории для пары валют
+func lastRecordForPair(history []ConversionRecord, from, to string) (ConversionRecord, bool) {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].FromCurrency == from && history[i].ToCurrency == to {
+			return history[i], true
+		}
+	}
+	return ConversionRecord{}, false
+}
 
-	if rate, ok := rates.Rates[to]; ok {
-		fmt.Println()
-		color.Cyan("Курс: 1 %s = %.4f %s", from, rate, to)
+// rateChanged сообщает, отличается ли курс от прошлой проверки; первая проверка считается изменением
+func rateChanged(prev ConversionRecord, found bool, rate float64) bool {
+	return !found || prev.ExchangeRate != rate
+}
+
+// deltaColor цвет строки изменения курса: с --color-delta по направлению движения, иначе обычный
+func deltaColor(prev ConversionRecord, found bool, rate float64, enabled bool) color.Attribute {
+	if !enabled || !found {
+		return color.FgCyan
 	}
+	return movementColor(rate, prev.ExchangeRate)
+}
 
-	// Вывод времени последнего обновления
-	updateTime := time.Unix(rates.TimeLastUpdated, 0)
-	timeAgo := formatTimeAgo(time.Since(updateTime))
-	fmt.Println()
-	color.HiBlack("Последнее обновление: %s (%s)", updateTime.Format("2006-01-02 15:04:05"), timeAgo)
+// bellWanted решает, подавать ли звуковой сигнал: только при изменениях, без --no-bell и в терминал
+func bellWanted(changed int, opts Options, terminal bool) bool {
+	return opts.Bell && !opts.NoBell && changed > 0 && terminal
+}
 
-	fmt.Println()
-	color.Set(color.FgYellow, color.Bold)
-	fmt.Println("═══════════════════════════════════════════")
-	color.Unset()
+// ringBell подаёт звуковой сигнал терминала, если курс изменился
+func ringBell(changed int, opts Options) {
+	if bellWanted(changed, opts, stdoutIsTerminal()) {
+		fmt.Print("\a")
+	}
 }
 
-// outputJSON выводит результат в формате JSON
-func outputJSON(from, to string, amount, result, rate float64, updateTime time.Time) {
-	output := JSONOutput{
-		Success:        true,
-		Timestamp:      time.Now(),
-		FromCurrency:   from,
-		ToCurrency:     to,
-		Amount:         amount,
-		Result:         result,
-		ExchangeRate:   rate,
-		RateUpdateTime: updateTime,
+// sinceLastRunMessage формирует сообщение об изменении курса с прошлой проверки
+func sinceLastRunMessage(prev ConversionRecord, found bool, rate float64, now time.Time) string {
+	if !found || prev.ExchangeRate == 0 {
+		return "📍 Первая проверка"
 	}
+	change := (rate - prev.ExchangeRate) / prev.ExchangeRate * 100
+	return fmt.Sprintf("📈 Курс изменился на %s с последней проверки (%s)",
+		formatPercent(change, true), formatTimeAgo(now.Sub(prev.Timestamp)))
+}
 
-	data, err := json.MarshalIndent(output, "", "  ")
-	if err != nil {
-		outputError(fmt.Sprintf("ошибка формирования JSON: %v", err), true)
-		os.Exit(1)
+// sinceLastRunCell краткая запись изменения курса для колонки Markdown-таблицы:
+// процент с прошлой проверки или «—», если пара проверяется впервые
+func sinceLastRunCell(prev ConversionRecord, found bool, rate float64) string {
+	if !found || prev.ExchangeRate == 0 {
+		return "—"
 	}
+	return formatPercent((rate-prev.ExchangeRate)/prev.ExchangeRate*100, true)
+}
 
-	fmt.Println(string(data))
+// redactURL убирает из адреса запроса данные авторизации и значения параметров
+// с ключами, чтобы журнал аудита можно было передавать без секретов
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[некорректный URL]"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	query := u.Query()
+	for key := range query {
+		switch strings.ToLower(key) {
+		case "key", "apikey", "api_key", "access_key", "app_id", "token":
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
 }
 
-// outputCSV выводит результат в формате CSV
-func outputCSV(from, to string, amount, result, rate float64, _ time.Time) {
-	// timestamp,from,to,amount,result,rate
-	fmt.Printf("%s,%s,%s,%.2f,%.2f,%.6f\n",
-		time.Now().Format(time.RFC3339),
-		from,
-		to,
-		amount,
-		result,
-		rate,
-	)
+// hashResponse возвращает sha256 тела ответа в шестнадцатеричном виде
+func hashResponse(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
 }
 
-// outputError выводит ошибку в формате JSON или CSV
-func outputError(message string, asJSON bool) {
-	if asJSON {
-		output := map[string]any{
-			"success": false,
-			"error":   message,
+// openAuditLog проверяет путь и открывает журнал аудита только на дозапись
+func openAuditLog(path string) (*os.File, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("%s — каталог, а не файл", path)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("каталог %s не существует", dir)
 		}
-		data, _ := json.MarshalIndent(output, "", "  ")
-		fmt.Println(string(data))
-	} else {
-		// CSV формат ошибки
-		fmt.Printf("error,%s\n", message)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// writeAuditRecord дописывает запись одной строкой JSON и сбрасывает её на диск
+func writeAuditRecord(f *os.File, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// recordAudit пишет операцию в журнал аудита, если он включён
+func recordAudit(from, to string, amount, result, rate float64, rates *ExchangeRateResponse) {
+	if auditLog == nil {
+		return
+	}
+	record := AuditRecord{
+		Timestamp:    time.Now(),
+		Provider:     rates.Provider,
+		RequestURL:   rates.RequestURL,
+		ResponseHash: rates.ResponseHash,
+		Cached:       rates.Cached,
+		FromCurrency: from,
+		ToCurrency:   to,
+		Amount:       amount,
+		Result:       result,
+		ExchangeRate: rate,
+	}
+	if err := writeAuditRecord(auditLog, record); err != nil {
+		addWarning("не удалось записать журнал аудита: %v", err)
 	}
 }
 
@@ -585,17 +6486,13 @@ func saveToHistory(from, to string, amount, result, rate float64, updateTime tim
 	}
 
 	// Читаем существующую историю
-	var history []ConversionRecord
-	data, err := os.ReadFile(historyFile)
-	if err == nil {
-		json.Unmarshal(data, &history)
-	}
+	history := loadHistory()
 
 	// Добавляем новую запись
 	history = append(history, record)
 
 	// Сохраняем обратно
-	data, err = json.MarshalIndent(history, "", "  ")
+	data, err := json.MarshalIndent(history, "", "  ")
 	if err != nil {
 		return
 	}